@@ -1,256 +1,3522 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"net"
 	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/Masterminds/semver/v3"
 	"github.com/cucumber/godog"
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/google/cel-go/cel"
+	"github.com/google/uuid"
+	"github.com/nsf/jsondiff"
 )
 
+// Suite-wide request settings, overridable via GODOG_USER_AGENT and GODOG_DEBUG.
+var (
+	userAgent = "godog-bdd/1.0"
+	debug     bool
+)
+
+// traceDir holds GODOG_TRACE_DIR; when set, each scenario's requests and
+// responses are written to a transcript file there.
+var traceDir string
+
+// Transcript names already written, so outline examples and same-named
+// scenarios in different features don't overwrite each other.
+var (
+	traceMu    sync.Mutex
+	traceNames = map[string]int{}
+)
+
+// scenarioFilter holds the GODOG_NAME pattern; scenarios whose name does not
+// match are skipped.
+var scenarioFilter *regexp.Regexp
+
+// client is shared by every scenario so connections are reused across the
+// suite. Per-scenario tweaks must be undone in the After hook.
+var client = &http.Client{
+	Transport: http.DefaultTransport.(*http.Transport).Clone(),
+}
+
+// configureTransport applies suite-wide transport settings from the
+// environment. It runs once before any scenario.
+func configureTransport() error {
+	transport := client.Transport.(*http.Transport)
+	tlsConfig, err := loadTLSConfig()
+	if err != nil {
+		return err
+	}
+	if os.Getenv("GODOG_INSECURE_TLS") == "1" {
+		fmt.Fprintln(os.Stderr, "WARNING: GODOG_INSECURE_TLS=1, server certificates will NOT be verified")
+		if tlsConfig == nil {
+			tlsConfig = &tls.Config{}
+		}
+		tlsConfig.InsecureSkipVerify = true
+	}
+	if tlsConfig != nil {
+		transport.TLSClientConfig = tlsConfig
+	}
+	if os.Getenv("GODOG_H2C") == "1" {
+		// Prior-knowledge HTTP/2 over cleartext for http:// URLs; HTTP/1 must be
+		// disabled or the transport keeps using it for plain connections
+		protocols := new(http.Protocols)
+		protocols.SetHTTP2(true)
+		protocols.SetUnencryptedHTTP2(true)
+		transport.Protocols = protocols
+	}
+	if override := os.Getenv("GODOG_HOST_OVERRIDE"); override != "" {
+		host, ip, ok := strings.Cut(override, ":")
+		if !ok || host == "" || net.ParseIP(ip) == nil {
+			return fmt.Errorf("invalid GODOG_HOST_OVERRIDE '%s', expected host:ip", override)
+		}
+		// Only the dialled address changes, so the Host header and TLS server
+		// name still carry the original hostname
+		dial := transport.DialContext
+		transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			if h, port, err := net.SplitHostPort(addr); err == nil && strings.EqualFold(h, host) {
+				addr = net.JoinHostPort(ip, port)
+			}
+			return dial(ctx, network, addr)
+		}
+	}
+	return nil
+}
+
+// loadTLSConfig builds a mutual TLS config from GODOG_CLIENT_CERT,
+// GODOG_CLIENT_KEY and GODOG_CA_CERT. It returns nil when none are set.
+func loadTLSConfig() (*tls.Config, error) {
+	certFile := os.Getenv("GODOG_CLIENT_CERT")
+	keyFile := os.Getenv("GODOG_CLIENT_KEY")
+	caFile := os.Getenv("GODOG_CA_CERT")
+	if certFile == "" && keyFile == "" && caFile == "" {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{}
+	if certFile != "" || keyFile != "" {
+		if certFile == "" || keyFile == "" {
+			return nil, fmt.Errorf("GODOG_CLIENT_CERT and GODOG_CLIENT_KEY must be set together")
+		}
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate '%s': %v", certFile, err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA certificate '%s': %v", caFile, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA file '%s'", caFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	return tlsConfig, nil
+}
+
 // API Context
 type apiContext struct {
-	BaseURL      string
-	Resp         *http.Response
-	TemplateIDs  map[string]string
-	PolicyIDs    map[string]string
-	ResponseBody interface{}
+	BaseURL         string
+	SecondaryURL    string
+	APIPrefix       string
+	Environment     string
+	Headers         map[string]string
+	Resp            *http.Response
+	TemplateIDs     map[string]string
+	PolicyIDs       map[string]string
+	PolicyTemplates map[string]string
+	TemplateSources map[string]string
+	ResponseBody    interface{}
+	RawBody         []byte
+	Trace           []interface{}
+	RequestSpec     string
+	LastRequest     *sentRequest
+	LastFacts       interface{}
+	Snapshots       map[string]interface{}
+	Cookies         []*http.Cookie
+	Timestamps      map[string]time.Time
+	RequestID       string
+	Vars            map[string]string
+	NumVars         map[string]float64
+	Features        map[string]bool
+	IDField         string
+	ExactNumbers    bool
+	Transcript      *bytes.Buffer
+	Requests        []string
+}
+
+// sentRequest records what sendRequest or iDownload sent so it can be replayed.
+type sentRequest struct {
+	Method   string
+	Endpoint string
+	Payload  []byte
+	Headers  map[string]string
+	Download bool
+}
+
+// Environment profiles
+
+const envFile = "godog-env.json"
+
+// environment is a named profile in godog-env.json, selected via GODOG_ENV.
+type environment struct {
+	BaseURL      string            `json:"base_url"`
+	SecondaryURL string            `json:"secondary_base_url"`
+	Headers      map[string]string `json:"headers"`
+	Auth         struct {
+		BearerToken string `json:"bearer_token"`
+		Username    string `json:"username"`
+		Password    string `json:"password"`
+	} `json:"auth"`
+}
+
+func (c *apiContext) loadEnvironment() error {
+	name := os.Getenv("GODOG_ENV")
+	if name == "" {
+		return nil
+	}
+	data, err := os.ReadFile(envFile)
+	if err != nil {
+		return fmt.Errorf("GODOG_ENV is '%s' but %s could not be read: %v", name, envFile, err)
+	}
+	var envs map[string]environment
+	if err := json.Unmarshal(data, &envs); err != nil {
+		return fmt.Errorf("invalid %s: %v", envFile, err)
+	}
+	env, ok := envs[name]
+	if !ok {
+		available := make([]string, 0, len(envs))
+		for n := range envs {
+			available = append(available, n)
+		}
+		sort.Strings(available)
+		return fmt.Errorf("environment '%s' not found in %s (available: %s)", name, envFile, strings.Join(available, ", "))
+	}
+	if env.BaseURL == "" {
+		return fmt.Errorf("environment '%s' in %s has no base_url", name, envFile)
+	}
+
+	c.Environment = name
+	c.BaseURL = strings.TrimSuffix(env.BaseURL, "/")
+	c.SecondaryURL = strings.TrimSuffix(env.SecondaryURL, "/")
+	for k, v := range env.Headers {
+		c.Headers[k] = v
+	}
+	if env.Auth.BearerToken != "" {
+		c.Headers["Authorization"] = "Bearer " + env.Auth.BearerToken
+	} else if env.Auth.Username != "" {
+		creds := base64.StdEncoding.EncodeToString([]byte(env.Auth.Username + ":" + env.Auth.Password))
+		c.Headers["Authorization"] = "Basic " + creds
+	}
+	return nil
+}
+
+func (c *apiContext) reset() {
+	c.Resp = nil
+	c.ResponseBody = nil
+	c.RawBody = nil
+	c.Trace = nil
+	c.LastRequest = nil
+	c.LastFacts = nil
+	c.Snapshots = make(map[string]interface{})
+	c.Cookies = nil
+	c.Timestamps = make(map[string]time.Time)
+	c.RequestID = ""
+	c.Vars = make(map[string]string)
+	c.NumVars = make(map[string]float64)
+	c.Features = nil
+	c.IDField = "id"
+	c.ExactNumbers = false
+	c.Transcript = nil
+	c.Requests = nil
+}
+
+// OpenAPI specs
+
+// Parsed specs are shared by every scenario in the suite.
+var (
+	specMu    sync.Mutex
+	specCache = map[string]*openapi3.T{}
+)
+
+func loadSpec(location string) (*openapi3.T, error) {
+	specMu.Lock()
+	defer specMu.Unlock()
+	if doc, ok := specCache[location]; ok {
+		return doc, nil
+	}
+	loader := openapi3.NewLoader()
+	loader.IsExternalRefsAllowed = true
+	doc, err := loader.LoadFromFile(location)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load OpenAPI spec '%s': %v", location, err)
+	}
+	if err := doc.Validate(loader.Context); err != nil {
+		return nil, fmt.Errorf("invalid OpenAPI spec '%s': %v", location, err)
+	}
+	specCache[location] = doc
+	return doc, nil
+}
+
+func findOperation(doc *openapi3.T, operationID string) (*openapi3.Operation, error) {
+	for _, item := range doc.Paths.Map() {
+		for _, op := range item.Operations() {
+			if op.OperationID == operationID {
+				return op, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("operation '%s' not found in spec", operationID)
+}
+
+// findOperationByRoute matches a request path against the spec's path
+// templates, treating each {param} segment as a wildcard.
+func findOperationByRoute(doc *openapi3.T, method, endpoint string) (*openapi3.Operation, error) {
+	endpoint, _, _ = strings.Cut(endpoint, "?")
+	segments := strings.Split(strings.Trim(endpoint, "/"), "/")
+	for template, item := range doc.Paths.Map() {
+		parts := strings.Split(strings.Trim(template, "/"), "/")
+		if len(parts) != len(segments) {
+			continue
+		}
+		matched := true
+		for i, part := range parts {
+			if !strings.HasPrefix(part, "{") && part != segments[i] {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			if op := item.GetOperation(method); op != nil {
+				return op, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("no operation for %s %s in spec", method, endpoint)
+}
+
+// validateRequestBody checks a JSON payload against the request-body schema
+// of the matching operation in RequestSpec. A versioned endpoint also matches
+// the spec's un-prefixed path, for specs that put the version in their server
+// URL instead of their paths.
+func (c *apiContext) validateRequestBody(method, endpoint string, payload []byte) error {
+	doc, err := loadSpec(c.RequestSpec)
+	if err != nil {
+		return err
+	}
+	op, err := findOperationByRoute(doc, method, endpoint)
+	if err != nil && c.APIPrefix != "" && strings.HasPrefix(endpoint, c.APIPrefix+"/") {
+		op, err = findOperationByRoute(doc, method, strings.TrimPrefix(endpoint, c.APIPrefix))
+	}
+	if err != nil {
+		return err
+	}
+	if op.RequestBody == nil || op.RequestBody.Value == nil {
+		return nil
+	}
+	media := op.RequestBody.Value.Content.Get("application/json")
+	if media == nil || media.Schema == nil || media.Schema.Value == nil {
+		return nil
+	}
+	var body interface{}
+	if err := json.Unmarshal(payload, &body); err != nil {
+		return fmt.Errorf("request body for %s %s is not valid JSON: %v", method, endpoint, err)
+	}
+	if err := media.Schema.Value.VisitJSON(body); err != nil {
+		return fmt.Errorf("request body for %s %s does not match spec '%s': %v", method, endpoint, c.RequestSpec, err)
+	}
+	return nil
+}
+
+// Step Definitions
+
+func (c *apiContext) theAPIIsAvailableAt(url string) error {
+	// A selected environment profile wins over the URL written in the feature
+	if c.Environment == "" {
+		c.BaseURL = url
+	}
+	req, err := c.newRequest(http.MethodGet, "/health", nil)
+	if err != nil {
+		return err
+	}
+	resp, _, err := c.doDirect(req)
+	if err != nil {
+		return fmt.Errorf("API check failed: %v", err)
+	}
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("API at %s responded with status %d", c.BaseURL, resp.StatusCode)
+	}
+	return nil
+}
+
+// aSecondEngineIsAvailableAt configures the engine compared against by the
+// "on both engines" steps. It shares the profile's headers and auth, and a
+// profile's secondary_base_url wins over the URL in the feature.
+func (c *apiContext) aSecondEngineIsAvailableAt(url string) error {
+	if c.Environment == "" || c.SecondaryURL == "" {
+		c.SecondaryURL = strings.TrimSuffix(url, "/")
+	}
+	return c.onSecondaryEngine(func() error {
+		return c.theAPIIsAvailableAt(c.BaseURL)
+	})
+}
+
+// onSecondaryEngine runs fn with requests going to the second engine.
+func (c *apiContext) onSecondaryEngine(fn func() error) error {
+	if c.SecondaryURL == "" {
+		return fmt.Errorf("no second engine configured, use 'a second engine is available at' or secondary_base_url")
+	}
+	primary, environment := c.BaseURL, c.Environment
+	c.BaseURL = c.SecondaryURL
+	// Keeps theAPIIsAvailableAt from restoring the profile's primary URL
+	c.Environment = ""
+	defer func() {
+		c.BaseURL, c.Environment = primary, environment
+	}()
+	return fn()
+}
+
+// theAPIVersionIs prefixes every subsequent API endpoint, e.g. "v2" turns
+// "/api/policies" into "/v2/api/policies". The health check is not prefixed.
+func (c *apiContext) theAPIVersionIs(version string) error {
+	version = strings.Trim(version, "/")
+	if version == "" {
+		c.APIPrefix = ""
+		return nil
+	}
+	c.APIPrefix = "/" + version
+	return nil
+}
+
+func (c *apiContext) requestValidationIsEnabledAgainst(specPath string) error {
+	if _, err := loadSpec(specPath); err != nil {
+		return err
+	}
+	c.RequestSpec = specPath
+	return nil
+}
+
+func (c *apiContext) redirectsShouldNotBeFollowed() error {
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	return nil
+}
+
+func (c *apiContext) iSetCookieTo(name, value string) error {
+	for _, cookie := range c.Cookies {
+		if cookie.Name == name {
+			cookie.Value = value
+			return nil
+		}
+	}
+	c.Cookies = append(c.Cookies, &http.Cookie{Name: name, Value: value})
+	return nil
+}
+
+func (c *apiContext) requestsShouldUseRequestID(id string) error {
+	c.RequestID = id
+	return nil
+}
+
+// thisScenarioRequiresFeature skips the scenario unless /api/features enables
+// the flag. Servers without the endpoint are treated as having no features.
+func (c *apiContext) thisScenarioRequiresFeature(name string) error {
+	if c.Features == nil {
+		if err := c.loadFeatures(); err != nil {
+			return err
+		}
+	}
+	if !c.Features[name] {
+		return godog.ErrSkip
+	}
+	return nil
+}
+
+// loadFeatures accepts either {"flag": true, ...} or ["flag", ...]. It uses the
+// client directly so the response under test and the last request are left
+// untouched.
+func (c *apiContext) loadFeatures() error {
+	req, err := c.newRequest(http.MethodGet, c.APIPrefix+"/api/features", nil)
+	if err != nil {
+		return err
+	}
+	resp, raw, err := c.doDirect(req)
+	if err != nil {
+		return err
+	}
+	c.Features = make(map[string]bool)
+	if resp.StatusCode == http.StatusNotFound {
+		return nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("fetching features returned status %d", resp.StatusCode)
+	}
+	var features interface{}
+	if err := json.Unmarshal(raw, &features); err != nil {
+		return fmt.Errorf("invalid features response: %v", err)
+	}
+	switch body := features.(type) {
+	case map[string]interface{}:
+		for name, enabled := range body {
+			c.Features[name] = enabled == true
+		}
+	case []interface{}:
+		for _, name := range body {
+			if s, ok := name.(string); ok {
+				c.Features[s] = true
+			}
+		}
+	default:
+		return fmt.Errorf("unexpected features response: %v", features)
+	}
+	return nil
+}
+
+// theIDFieldIs names the response key holding the created resource's ID, for
+// endpoints that return e.g. "uuid" or "policy_id" instead of "id".
+func (c *apiContext) theIDFieldIs(field string) error {
+	c.IDField = field
+	return nil
+}
+
+// responseNumbersAreDecodedExactly keeps numbers as json.Number for the rest
+// of the scenario, so large integer IDs survive comparisons and snapshots.
+func (c *apiContext) responseNumbersAreDecodedExactly() error {
+	c.ExactNumbers = true
+	return nil
+}
+
+// theServerStateIsReset calls the test-only reset endpoint. Servers without it
+// (e.g. production) only produce a warning and keep their state.
+func (c *apiContext) theServerStateIsReset() error {
+	err := c.sendRequest(http.MethodPost, "/api/test/reset", nil, nil)
+	if c.Resp != nil && c.Resp.StatusCode == http.StatusNotFound {
+		fmt.Fprintf(os.Stderr, "WARNING: %s has no /api/test/reset endpoint, server state was not reset\n", c.BaseURL)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if c.Resp.StatusCode < 200 || c.Resp.StatusCode >= 300 {
+		return fmt.Errorf("server reset returned status %d: %v", c.Resp.StatusCode, c.ResponseBody)
+	}
+	c.TemplateIDs = make(map[string]string)
+	c.TemplateSources = make(map[string]string)
+	c.PolicyIDs = make(map[string]string)
+	c.PolicyTemplates = make(map[string]string)
+	c.Vars = make(map[string]string)
+	return nil
+}
+
+func (c *apiContext) aRuleTemplateExists(name string) error {
+	source := `rule("default").when(f => true).then(f => ({result: "ok"}))`
+	return c.createTemplate(name, source)
+}
+
+func (c *apiContext) aRuleTemplateExistsWithSource(name, source string) error {
+	return c.createTemplate(name, source)
+}
+
+// ruleTemplatesAreLoadedFromDirectory creates one template per .js/.dsl file,
+// named after the file without its extension.
+func (c *apiContext) ruleTemplatesAreLoadedFromDirectory(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("failed to read template directory '%s': %v", dir, err)
+	}
+	var failed []string
+	loaded := 0
+	for _, entry := range entries {
+		ext := filepath.Ext(entry.Name())
+		if entry.IsDir() || (ext != ".js" && ext != ".dsl") {
+			continue
+		}
+		source, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return err
+		}
+		name := strings.TrimSuffix(entry.Name(), ext)
+		if err := c.createTemplate(name, string(source)); err != nil {
+			failed = append(failed, fmt.Sprintf("%s (%v)", entry.Name(), err))
+			continue
+		}
+		if c.Resp.StatusCode != http.StatusCreated {
+			failed = append(failed, fmt.Sprintf("%s (status %d)", entry.Name(), c.Resp.StatusCode))
+			continue
+		}
+		loaded++
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to create %d templates from '%s': %s", len(failed), dir, strings.Join(failed, ", "))
+	}
+	if loaded == 0 {
+		return fmt.Errorf("no .js or .dsl templates found in '%s'", dir)
+	}
+	return nil
+}
+
+// creatingTemplatesShouldYieldIncreasingIDs creates count throwaway templates
+// and deletes them again afterwards. Non-numeric IDs such as UUIDs carry no
+// ordering, so the scenario is skipped rather than failed.
+func (c *apiContext) creatingTemplatesShouldYieldIncreasingIDs(count int) (err error) {
+	source := `rule("default").when(f => true).then(f => ({result: "ok"}))`
+	prefix := fmt.Sprintf("bdd-seq-%d", time.Now().UnixNano())
+	var created []string
+	defer func() {
+		for _, id := range created {
+			if cleanupErr := c.deleteResource("/api/rule-templates/" + id); cleanupErr != nil && err == nil {
+				err = fmt.Errorf("cleanup: %v", cleanupErr)
+			}
+		}
+	}()
+
+	ids := make([]int64, 0, count)
+	for i := 0; i < count; i++ {
+		name := fmt.Sprintf("%s-%d", prefix, i)
+		if err := c.createTemplate(name, source); err != nil {
+			return err
+		}
+		if c.Resp.StatusCode != http.StatusCreated {
+			return fmt.Errorf("creating template '%s' returned status %d", name, c.Resp.StatusCode)
+		}
+		raw, err := lookupPath(c.ResponseBody, c.IDField)
+		if err != nil {
+			return err
+		}
+		created = append(created, jsonScalarString(raw))
+		var id int64
+		switch v := raw.(type) {
+		case float64:
+			id = int64(v)
+		case json.Number:
+			if id, err = v.Int64(); err != nil {
+				return fmt.Errorf("template %s '%s' is not an integer", c.IDField, v)
+			}
+		case string:
+			if id, err = strconv.ParseInt(v, 10, 64); err != nil {
+				fmt.Fprintf(os.Stderr, "NOTE: template IDs are not numeric (got '%s'), ID ordering check skipped\n", v)
+				return godog.ErrSkip
+			}
+		default:
+			return fmt.Errorf("unexpected %s type %T for template '%s'", c.IDField, raw, name)
+		}
+		if len(ids) > 0 && id <= ids[len(ids)-1] {
+			return fmt.Errorf("expected IDs to increase, got %d after %d (IDs so far: %v)", id, ids[len(ids)-1], ids)
+		}
+		ids = append(ids, id)
+	}
+	return nil
+}
+
+// validatingInvalidSourceShouldReportLine submits the docstring as a new
+// template, which the server compiles before saving, and expects the error to
+// locate the problem in a "line" field at the top level or under "details" or
+// "error".
+func (c *apiContext) validatingInvalidSourceShouldReportLine(line int, docstring *godog.DocString) error {
+	name := fmt.Sprintf("bdd-invalid-%d", time.Now().UnixNano())
+	if err := c.createTemplate(name, docstring.Content); err != nil {
+		return err
+	}
+	if c.Resp.StatusCode >= 200 && c.Resp.StatusCode < 300 {
+		if id, ok := c.TemplateIDs[name]; ok {
+			if err := c.deleteResource("/api/rule-templates/" + id); err != nil {
+				return fmt.Errorf("invalid source was accepted, and cleanup failed: %v", err)
+			}
+		}
+		return fmt.Errorf("expected the source to be rejected, but it was accepted")
+	}
+	for _, path := range []string{"line", "details.line", "error.line"} {
+		raw, err := lookupPath(c.ResponseBody, path)
+		if err != nil {
+			continue
+		}
+		got, ok := toFloat(raw)
+		if !ok || int(got) != line {
+			return fmt.Errorf("expected the error at line %d, got %s %v: %v", line, path, raw, c.ResponseBody)
+		}
+		return nil
+	}
+	return fmt.Errorf("error response has no line number: %v", c.ResponseBody)
+}
+
+// creatingTemplateAgainShouldConflict re-posts a template created earlier in
+// the scenario, with its original source, and expects the name to be taken.
+func (c *apiContext) creatingTemplateAgainShouldConflict(name string) error {
+	source, ok := c.TemplateSources[name]
+	if !ok {
+		return fmt.Errorf("template '%s' not found", name)
+	}
+	if err := c.createTemplate(name, source); err != nil {
+		return err
+	}
+	if c.Resp.StatusCode != http.StatusConflict {
+		return fmt.Errorf("expected creating template '%s' again to conflict (409), got status %d: %v", name, c.Resp.StatusCode, c.ResponseBody)
+	}
+	return nil
+}
+
+func (c *apiContext) createTemplate(name, source string) error {
+	payload := map[string]string{
+		"name":   name,
+		"source": strings.TrimSpace(source),
+	}
+	return c.sendPostRequest("/api/rule-templates", payload)
+}
+
+func (c *apiContext) aPolicyExists(name, templateName string) error {
+	payload, err := c.policyPayload(name, templateName)
+	if err != nil {
+		return err
+	}
+	c.PolicyTemplates[name] = templateName
+	return c.sendPostRequest("/api/policies", payload)
+}
+
+// creatingPolicyShouldMakeItRetrievable creates a policy from the template it
+// was last created with or, failing that, the scenario's only template.
+func (c *apiContext) creatingPolicyShouldMakeItRetrievable(name string) error {
+	templateName, ok := c.PolicyTemplates[name]
+	if !ok {
+		if len(c.TemplateIDs) != 1 {
+			return fmt.Errorf("cannot choose a template for policy '%s' among %d templates, create it with a template first", name, len(c.TemplateIDs))
+		}
+		for n := range c.TemplateIDs {
+			templateName = n
+		}
+	}
+	if err := c.aPolicyExists(name, templateName); err != nil {
+		return err
+	}
+	if c.Resp.StatusCode < 200 || c.Resp.StatusCode >= 300 {
+		return fmt.Errorf("creating policy '%s' returned status %d: %v", name, c.Resp.StatusCode, c.ResponseBody)
+	}
+	created, ok := c.ResponseBody.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("create response is not an object")
+	}
+	rawID, err := lookupPath(created, c.IDField)
+	if err != nil || rawID == nil {
+		return fmt.Errorf("create response has no %s: %v", c.IDField, created)
+	}
+	policyID := jsonScalarString(rawID)
+	if err := c.iGet("/api/policies/" + policyID); err != nil {
+		return err
+	}
+	if c.Resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("fetching created policy '%s' (%s) returned status %d", name, policyID, c.Resp.StatusCode)
+	}
+	retrieved, ok := c.ResponseBody.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("response is not an object")
+	}
+	var mismatches []string
+	for _, field := range []string{"name", "rule_template_id", "rule_template_version"} {
+		if !reflect.DeepEqual(created[field], retrieved[field]) {
+			mismatches = append(mismatches, fmt.Sprintf("%s: created %v, retrieved %v", field, created[field], retrieved[field]))
+		}
+	}
+	if retrieved["name"] != name {
+		mismatches = append(mismatches, fmt.Sprintf("name: expected '%s', retrieved %v", name, retrieved["name"]))
+	}
+	if len(mismatches) > 0 {
+		return fmt.Errorf("retrieved policy '%s' differs from the created one:\n  %s", name, strings.Join(mismatches, "\n  "))
+	}
+	return nil
+}
+
+// disablingPolicyShouldPreventExecution disables the policy, then expects an
+// execution to be refused as disabled or to fire no rules. The policy is
+// re-enabled afterwards.
+func (c *apiContext) disablingPolicyShouldPreventExecution(name string) (err error) {
+	policyID, ok := c.PolicyIDs[name]
+	if !ok {
+		return fmt.Errorf("policy '%s' not found", name)
+	}
+	endpoint := "/api/policies/" + policyID
+	if err := c.sendPatchRequest(endpoint, map[string]interface{}{"enabled": false}); err != nil {
+		return err
+	}
+	if c.Resp.StatusCode < 200 || c.Resp.StatusCode >= 300 {
+		return fmt.Errorf("disabling policy '%s' returned status %d", name, c.Resp.StatusCode)
+	}
+	defer func() {
+		cleanupErr := c.sendPatchRequest(endpoint, map[string]interface{}{"enabled": true})
+		if cleanupErr == nil && (c.Resp.StatusCode < 200 || c.Resp.StatusCode >= 300) {
+			cleanupErr = fmt.Errorf("status %d", c.Resp.StatusCode)
+		}
+		if cleanupErr != nil && err == nil {
+			err = fmt.Errorf("re-enabling policy '%s': %v", name, cleanupErr)
+		}
+	}()
+
+	if err := c.executePolicy(name, "{}", nil); err != nil {
+		return err
+	}
+	bodyMap, _ := c.ResponseBody.(map[string]interface{})
+	if success, _ := bodyMap["success"].(bool); success {
+		rules, err := c.firedRules()
+		if err != nil {
+			return err
+		}
+		if len(rules) > 0 {
+			return fmt.Errorf("disabled policy '%s' still fired rules: %v", name, rules)
+		}
+		return nil
+	}
+	message := strings.ToLower(c.responseErrorMessage())
+	if !strings.Contains(message, "disabled") && !strings.Contains(message, "inactive") {
+		return fmt.Errorf("expected execution of disabled policy '%s' to be refused as disabled, got status %d: %v", name, c.Resp.StatusCode, c.ResponseBody)
+	}
+	return nil
+}
+
+// theFollowingPoliciesExist creates one policy per row of a table with "name"
+// and "template" header columns, reporting every row that failed.
+func (c *apiContext) theFollowingPoliciesExist(table *godog.Table) error {
+	if len(table.Rows) == 0 {
+		return fmt.Errorf("policy table is empty")
+	}
+	nameCol, templateCol := -1, -1
+	for i, cell := range table.Rows[0].Cells {
+		switch cell.Value {
+		case "name":
+			nameCol = i
+		case "template":
+			templateCol = i
+		}
+	}
+	if nameCol < 0 || templateCol < 0 {
+		return fmt.Errorf("policy table needs 'name' and 'template' columns")
+	}
+	var failed []string
+	for _, row := range table.Rows[1:] {
+		name, templateName := row.Cells[nameCol].Value, row.Cells[templateCol].Value
+		if err := c.aPolicyExists(name, templateName); err != nil {
+			failed = append(failed, fmt.Sprintf("'%s': %v", name, err))
+			continue
+		}
+		if c.Resp.StatusCode < 200 || c.Resp.StatusCode >= 300 {
+			failed = append(failed, fmt.Sprintf("'%s': status %d", name, c.Resp.StatusCode))
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to create %d of %d policies:\n  %s", len(failed), len(table.Rows)-1, strings.Join(failed, "\n  "))
+	}
+	return nil
+}
+
+func (c *apiContext) policyPayload(name, templateName string) (map[string]interface{}, error) {
+	templateID, ok := c.TemplateIDs[templateName]
+	if !ok {
+		return nil, fmt.Errorf("template '%s' not found", templateName)
+	}
+
+	return map[string]interface{}{
+		"name":             name,
+		"rule_template_id": templateID,
+		"metadata":         map[string]interface{}{},
+	}, nil
+}
+
+// creatingPolicyTwiceShouldReturnTheSameID re-posts a policy created earlier in
+// the scenario, using the same template, and expects the server to dedupe it.
+func (c *apiContext) creatingPolicyTwiceShouldReturnTheSameID(name string) error {
+	templateName, ok := c.PolicyTemplates[name]
+	if !ok {
+		return fmt.Errorf("policy '%s' has no known template, create it with a template first", name)
+	}
+	payload, err := c.policyPayload(name, templateName)
+	if err != nil {
+		return err
+	}
+	var ids [2]string
+	for i := range ids {
+		if err := c.sendPostRequest("/api/policies", payload); err != nil {
+			return err
+		}
+		id, err := c.responseString(c.IDField)
+		if err != nil {
+			return fmt.Errorf("create %d: %v", i+1, err)
+		}
+		ids[i] = id
+	}
+	if ids[0] != ids[1] {
+		return fmt.Errorf("expected creating policy '%s' twice to return the same ID, got '%s' and '%s'", name, ids[0], ids[1])
+	}
+	return nil
+}
+
+func (c *apiContext) iPostToWith(endpoint string, docstring *godog.DocString) error {
+	var payload interface{}
+	if err := json.Unmarshal([]byte(docstring.Content), &payload); err != nil {
+		return err
+	}
+	return c.sendPostRequest(endpoint, payload)
+}
+
+func (c *apiContext) iPatchWith(endpoint string, docstring *godog.DocString) error {
+	var payload interface{}
+	if err := json.Unmarshal([]byte(docstring.Content), &payload); err != nil {
+		return err
+	}
+	return c.sendPatchRequest(endpoint, payload)
+}
+
+// iPostToAs sends the docstring verbatim with the given content type.
+func (c *apiContext) iPostToAs(endpoint, contentType string, docstring *godog.DocString) error {
+	return c.sendRejectableRequest(http.MethodPost, endpoint, []byte(docstring.Content), map[string]string{"Content-Type": contentType})
+}
+
+func (c *apiContext) iPostGzippedToWith(endpoint string, docstring *godog.DocString) error {
+	payload := []byte(docstring.Content)
+	if !json.Valid(payload) {
+		return fmt.Errorf("request body is not valid JSON")
+	}
+	// sendRequest cannot inspect a compressed body, so validate it here,
+	// against the same path sendRequest will send to
+	endpoint, path, err := c.resolveEndpoint(endpoint)
+	if err != nil {
+		return err
+	}
+	if c.RequestSpec != "" {
+		if err := c.validateRequestBody(http.MethodPost, path, payload); err != nil {
+			return err
+		}
+	}
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if _, err := gz.Write(payload); err != nil {
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+	return c.sendRejectableRequest(http.MethodPost, endpoint, buf.Bytes(), map[string]string{
+		"Content-Type":     "application/json",
+		"Content-Encoding": "gzip",
+	})
+}
+
+// iPostAPayloadOfKilobytesTo posts a JSON object padded to exactly the given
+// size, for checking request body limits.
+func (c *apiContext) iPostAPayloadOfKilobytesTo(size int, endpoint string) error {
+	const envelope = `{"padding":""}`
+	padding := size*1024 - len(envelope)
+	if padding < 0 {
+		padding = 0
+	}
+	payload := []byte(`{"padding":"` + strings.Repeat("x", padding) + `"}`)
+	return c.sendRejectableRequest(http.MethodPost, endpoint, payload, map[string]string{"Content-Type": "application/json"})
+}
+
+// iSendACORSPreflightFrom asks whether a JSON POST from origin is allowed, the
+// typical cross-origin call that triggers a preflight.
+func (c *apiContext) iSendACORSPreflightFrom(endpoint, origin string) error {
+	return c.sendRequest(http.MethodOptions, endpoint, nil, map[string]string{
+		"Origin":                         origin,
+		"Access-Control-Request-Method":  http.MethodPost,
+		"Access-Control-Request-Headers": "content-type",
+	})
+}
+
+// iDownload fetches a binary response such as an export. It bypasses
+// sendRequest's JSON parsing and keeps the bytes in RawBody.
+func (c *apiContext) iDownload(endpoint string) error {
+	endpoint, path, err := c.resolveEndpoint(endpoint)
+	if err != nil {
+		return err
+	}
+	req, err := c.newRequest(http.MethodGet, path, nil)
+	if err != nil {
+		return err
+	}
+	c.LastRequest = &sentRequest{Method: http.MethodGet, Endpoint: endpoint, Download: true}
+	c.ResponseBody = nil
+	c.RawBody = nil
+	resp, err := client.Do(req)
+	if err != nil {
+		c.Resp = nil
+		c.traceExchange(req, nil, err)
+		return err
+	}
+	defer resp.Body.Close()
+	c.Resp = resp
+	c.RawBody, err = io.ReadAll(resp.Body)
+	c.traceExchange(req, nil, err)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("downloading '%s' returned status %d", endpoint, resp.StatusCode)
+	}
+	return nil
+}
+
+func (c *apiContext) iHead(endpoint string) error {
+	return c.sendRequest(http.MethodHead, endpoint, nil, nil)
+}
+
+func (c *apiContext) iGet(endpoint string) error {
+	return c.sendRequest(http.MethodGet, endpoint, nil, nil)
+}
+
+func (c *apiContext) executingPolicyTwiceShouldYieldIdenticalOutput(name string, docstring *godog.DocString) error {
+	var outputs [2]interface{}
+	for i := range outputs {
+		if err := c.executePolicy(name, docstring.Content, nil); err != nil {
+			return err
+		}
+		output, err := c.outputFacts()
+		if err != nil {
+			return fmt.Errorf("execution %d: %v", i+1, err)
+		}
+		outputs[i] = output
+	}
+	if diff := jsonDiff(outputs[0], outputs[1]); diff != "" {
+		return fmt.Errorf("policy '%s' produced different output on the second run:\n%s", name, diff)
+	}
+	return nil
+}
+
+func (c *apiContext) iRepeatTheLastRequest() error {
+	last := c.LastRequest
+	if last == nil {
+		return fmt.Errorf("no request has been sent yet")
+	}
+	if last.Download {
+		return c.iDownload(last.Endpoint)
+	}
+	return c.sendRequest(last.Method, last.Endpoint, last.Payload, last.Headers)
+}
+
+// theResponseListOrderShouldBeStableAcrossCalls re-sends the last GET calls
+// times and compares the order of item IDs, or of the items themselves for
+// lists of plain values such as template names.
+func (c *apiContext) theResponseListOrderShouldBeStableAcrossCalls(calls int) error {
+	last := c.LastRequest
+	if last == nil || last.Method != http.MethodGet || last.Download {
+		return fmt.Errorf("ordering stability needs a previous GET request")
+	}
+	var baseline []string
+	for i := 1; i <= calls; i++ {
+		if err := c.iRepeatTheLastRequest(); err != nil {
+			return fmt.Errorf("call %d: %v", i, err)
+		}
+		if c.Resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("call %d returned status %d", i, c.Resp.StatusCode)
+		}
+		list, err := c.responseList()
+		if err != nil {
+			return fmt.Errorf("call %d: %v", i, err)
+		}
+		order := make([]string, 0, len(list))
+		for _, item := range list {
+			if obj, ok := item.(map[string]interface{}); ok {
+				order = append(order, fmt.Sprint(obj[c.IDField]))
+			} else {
+				order = append(order, fmt.Sprint(item))
+			}
+		}
+		if i == 1 {
+			baseline = order
+			continue
+		}
+		if !reflect.DeepEqual(order, baseline) {
+			return fmt.Errorf("call %d to '%s' returned a different order:\n  call 1: %v\n  call %d: %v", i, last.Endpoint, baseline, i, order)
+		}
+	}
+	return nil
+}
+
+// iGetAcceptingGzip asks for gzip explicitly, which stops the transport from
+// decompressing and stripping Content-Encoding so the raw encoding is visible.
+func (c *apiContext) iGetAcceptingGzip(endpoint string) error {
+	return c.sendRequest(http.MethodGet, endpoint, nil, map[string]string{"Accept-Encoding": "gzip"})
+}
+
+// reorderingFactsShouldNotChangeTheOutput executes with the top-level fact
+// keys in sorted and then reverse-sorted order. encoding/json always sorts map
+// keys, so the reversed document is assembled by hand.
+func (c *apiContext) reorderingFactsShouldNotChangeTheOutput(name string, docstring *godog.DocString) error {
+	var facts map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(docstring.Content), &facts); err != nil {
+		return fmt.Errorf("facts must be a JSON object: %v", err)
+	}
+	if len(facts) < 2 {
+		return fmt.Errorf("reordering needs at least two facts, got %d", len(facts))
+	}
+	sorted, _ := json.Marshal(facts)
+	keys := make([]string, 0, len(facts))
+	for k := range facts {
+		keys = append(keys, k)
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(keys)))
+	var reversed bytes.Buffer
+	reversed.WriteString("{")
+	for i, k := range keys {
+		if i > 0 {
+			reversed.WriteString(",")
+		}
+		key, _ := json.Marshal(k)
+		reversed.Write(key)
+		reversed.WriteString(":")
+		reversed.Write(facts[k])
+	}
+	reversed.WriteString("}")
+
+	var outputs [2]interface{}
+	for i, factsJSON := range []string{string(sorted), reversed.String()} {
+		if err := c.executePolicy(name, factsJSON, nil); err != nil {
+			return err
+		}
+		output, err := c.outputFacts()
+		if err != nil {
+			return fmt.Errorf("run %d: %v", i+1, err)
+		}
+		outputs[i] = output
+	}
+	if diff := jsonDiff(outputs[0], outputs[1]); diff != "" {
+		return fmt.Errorf("reordering the facts of policy '%s' changed its output:\n%s", name, diff)
+	}
+	return nil
+}
+
+func (c *apiContext) iExecutePolicyWithFacts(name string, docstring *godog.DocString) error {
+	return c.executePolicy(name, docstring.Content, nil)
+}
+
+func (c *apiContext) iExecutePolicyWithTracingAndFacts(name string, docstring *godog.DocString) error {
+	if err := c.executePolicy(name, docstring.Content, map[string]interface{}{"trace": true}); err != nil {
+		return err
+	}
+	bodyMap, ok := c.ResponseBody.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("response is not an object")
+	}
+	trace, ok := bodyMap["trace"].([]interface{})
+	if !ok {
+		return fmt.Errorf("trace not found in response: %v", c.ResponseBody)
+	}
+	c.Trace = trace
+	return nil
+}
+
+func (c *apiContext) iExecutePolicyAtRulesetVersionWithFacts(name, version string, docstring *godog.DocString) error {
+	if err := c.executePolicy(name, docstring.Content, map[string]interface{}{"ruleset_version": version}); err != nil {
+		return err
+	}
+	if c.Resp.StatusCode == http.StatusBadRequest {
+		return fmt.Errorf("ruleset version '%s' was rejected: %s", version, c.responseErrorMessage())
+	}
+	return nil
+}
+
+// executingPolicyWithIdempotencyKey sends the key as an Idempotency-Key
+// header; repeat it and compare snapshots to check exactly-once semantics.
+func (c *apiContext) executingPolicyWithIdempotencyKey(name, key string, docstring *godog.DocString) error {
+	previous, hadPrevious := c.Headers["Idempotency-Key"]
+	c.Headers["Idempotency-Key"] = key
+	defer func() {
+		if hadPrevious {
+			c.Headers["Idempotency-Key"] = previous
+		} else {
+			delete(c.Headers, "Idempotency-Key")
+		}
+	}()
+	return c.executePolicy(name, docstring.Content, nil)
+}
+
+func (c *apiContext) iDryRunPolicyWithFacts(name string, docstring *godog.DocString) error {
+	return c.executePolicy(name, docstring.Content, map[string]interface{}{"dry_run": true})
+}
+
+// iExecutePolicyWithFactsFromFile reads facts from fixtures/, expanding
+// ${name} references from saved variables or the environment.
+func (c *apiContext) iExecutePolicyWithFactsFromFile(name, file string) error {
+	path := filepath.Join("fixtures", file)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read facts file '%s': %v", path, err)
+	}
+	facts, err := c.expandVars(string(data))
+	if err != nil {
+		return fmt.Errorf("facts file '%s': %v", path, err)
+	}
+	if !json.Valid([]byte(facts)) {
+		return fmt.Errorf("facts file '%s' is not valid JSON", path)
+	}
+	return c.executePolicy(name, facts, nil)
+}
+
+// theDecisionForFactsShouldBe executes one row per table row. Columns other
+// than "decision" and "policy" are facts; cells that parse as JSON (numbers,
+// booleans) are sent as such, anything else as a string. Without a "policy"
+// column, the scenario must have exactly one policy.
+func (c *apiContext) theDecisionForFactsShouldBe(table *godog.Table) error {
+	if len(table.Rows) < 2 {
+		return fmt.Errorf("decision table needs a header row and at least one case")
+	}
+	header := table.Rows[0].Cells
+	decisionCol, policyCol := -1, -1
+	for i, cell := range header {
+		switch cell.Value {
+		case "decision":
+			decisionCol = i
+		case "policy":
+			policyCol = i
+		}
+	}
+	if decisionCol < 0 {
+		return fmt.Errorf("decision table needs a 'decision' column")
+	}
+	defaultPolicy := ""
+	if policyCol < 0 {
+		if len(c.PolicyIDs) != 1 {
+			return fmt.Errorf("decision table has no 'policy' column and the scenario has %d policies", len(c.PolicyIDs))
+		}
+		for name := range c.PolicyIDs {
+			defaultPolicy = name
+		}
+	}
+
+	var results []string
+	failed := 0
+	for r, row := range table.Rows[1:] {
+		facts := make(map[string]interface{})
+		policy := defaultPolicy
+		for i, cell := range row.Cells {
+			switch i {
+			case decisionCol:
+			case policyCol:
+				policy = cell.Value
+			default:
+				var v interface{}
+				if err := json.Unmarshal([]byte(cell.Value), &v); err != nil {
+					v = cell.Value
+				}
+				facts[header[i].Value] = v
+			}
+		}
+		expected := row.Cells[decisionCol].Value
+		factsJSON, _ := json.Marshal(facts)
+		got, err := c.rowDecision(policy, string(factsJSON))
+		switch {
+		case err != nil:
+			failed++
+			results = append(results, fmt.Sprintf("FAIL row %d %s: %v", r+1, factsJSON, err))
+		case got != expected:
+			failed++
+			results = append(results, fmt.Sprintf("FAIL row %d %s: expected '%s', got '%s'", r+1, factsJSON, expected, got))
+		default:
+			results = append(results, fmt.Sprintf("ok   row %d %s: '%s'", r+1, factsJSON, got))
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d decisions were wrong:\n  %s", failed, len(table.Rows)-1, strings.Join(results, "\n  "))
+	}
+	return nil
+}
+
+func (c *apiContext) rowDecision(policy, factsJSON string) (string, error) {
+	if err := c.executePolicy(policy, factsJSON, nil); err != nil {
+		return "", err
+	}
+	if c.Resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("status %d: %s", c.Resp.StatusCode, c.responseErrorMessage())
+	}
+	decision, err := c.outputField("decision")
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprint(decision), nil
+}
+
+// executingPolicyWithEmptyFactsShouldUseDefaults executes with {} and expects
+// success; follow it with output field steps to check the defaulted values.
+func (c *apiContext) executingPolicyWithEmptyFactsShouldUseDefaults(name string) error {
+	if err := c.executePolicy(name, "{}", nil); err != nil {
+		return err
+	}
+	if c.Resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("executing policy '%s' with empty facts returned status %d: %v", name, c.Resp.StatusCode, c.ResponseBody)
+	}
+	if err := c.theExecutionShouldSucceed(); err != nil {
+		return fmt.Errorf("policy '%s' did not fall back to defaults: %v", name, err)
+	}
+	_, err := c.outputFacts()
+	return err
+}
+
+// executingPolicyWithNullFactsShouldNotCrash accepts any handled outcome, a
+// result or a validation error, as long as the server does not fail with 500.
+func (c *apiContext) executingPolicyWithNullFactsShouldNotCrash(name string, docstring *godog.DocString) error {
+	c.Resp = nil
+	err := c.executePolicy(name, docstring.Content, nil)
+	// Crash pages are often not JSON, so the status is checked before parse errors
+	if c.Resp != nil && c.Resp.StatusCode >= http.StatusInternalServerError {
+		return fmt.Errorf("executing policy '%s' with null facts crashed with status %d: %s", name, c.Resp.StatusCode, c.RawBody)
+	}
+	return err
+}
+
+func (c *apiContext) executingAnUnknownPolicyShouldReturn404() error {
+	policyID := uuid.NewString()
+	payload := map[string]interface{}{
+		"policy_id": policyID,
+		"facts":     map[string]interface{}{},
+	}
+	if err := c.sendPostRequest("/api/execute", payload); err != nil {
+		return err
+	}
+	if c.Resp.StatusCode >= 200 && c.Resp.StatusCode < 300 {
+		return fmt.Errorf("executing unknown policy %s succeeded with status %d: %v", policyID, c.Resp.StatusCode, c.ResponseBody)
+	}
+	return c.theResponseStatusShouldBe(http.StatusNotFound)
+}
+
+func (c *apiContext) executingPolicyWithFactsShouldFailValidation(name string, docstring *godog.DocString) error {
+	return c.expectExecutionFailure(name, docstring.Content, "validation", "invalid", "type")
+}
+
+func (c *apiContext) executingPolicyShouldTimeOutWithFacts(name string, docstring *godog.DocString) error {
+	if err := c.executePolicy(name, docstring.Content, nil); err != nil {
+		return err
+	}
+	bodyMap, ok := c.ResponseBody.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("response is not an object")
+	}
+	if timedOut, _ := bodyMap["timed_out"].(bool); !timedOut {
+		return fmt.Errorf("expected execution of '%s' to time out, got: %v", name, c.ResponseBody)
+	}
+	return nil
+}
+
+func (c *apiContext) executingADeeplyChainedPolicyShouldReportADepthLimit(name string) error {
+	return c.expectExecutionFailure(name, "{}", "depth", "recursion")
+}
+
+// expectExecutionFailure executes a policy and expects it to be rejected,
+// either as {"success": false, "error": ...} or as an API error response,
+// with an error message mentioning one of the keywords.
+func (c *apiContext) expectExecutionFailure(name, factsJSON string, keywords ...string) error {
+	if err := c.executePolicy(name, factsJSON, nil); err != nil {
+		return err
+	}
+	bodyMap, ok := c.ResponseBody.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("response is not an object")
+	}
+	if success, _ := bodyMap["success"].(bool); success {
+		return fmt.Errorf("expected execution of '%s' to fail, but it succeeded: %v", name, c.ResponseBody)
+	}
+	message := c.responseErrorMessage()
+	if message == "" {
+		return fmt.Errorf("execution of '%s' failed without an error message: %v", name, c.ResponseBody)
+	}
+	lower := strings.ToLower(message)
+	for _, kw := range keywords {
+		if strings.Contains(lower, kw) {
+			return nil
+		}
+	}
+	return fmt.Errorf("expected execution error to mention %s, got '%s'", strings.Join(keywords, " or "), message)
+}
+
+// reCreatingTemplateShouldPreserveExecutionOutput deletes a template and its
+// policy, re-creates both under the same names from the source the server
+// returns, and checks the policy still produces the same output. The
+// re-created resources are deleted again whatever the outcome, so neither name
+// refers to a stored resource afterwards.
+func (c *apiContext) reCreatingTemplateShouldPreserveExecutionOutput(templateName string, docstring *godog.DocString) (err error) {
+	templateID, ok := c.TemplateIDs[templateName]
+	if !ok {
+		return fmt.Errorf("template '%s' not found", templateName)
+	}
+	policyName := ""
+	for p, t := range c.PolicyTemplates {
+		if t == templateName {
+			policyName = p
+			break
+		}
+	}
+	if policyName == "" {
+		return fmt.Errorf("no policy uses template '%s'", templateName)
+	}
+
+	if err := c.executePolicy(policyName, docstring.Content, nil); err != nil {
+		return err
+	}
+	baseline, err := c.outputFacts()
+	if err != nil {
+		return fmt.Errorf("baseline execution: %v", err)
+	}
+
+	if err := c.iGet("/api/rule-templates/" + templateID); err != nil {
+		return err
+	}
+	source, err := c.responseString("source")
+	if err != nil {
+		return err
+	}
+
+	var created []string
+	originalsDeleted := false
+	defer func() {
+		for _, endpoint := range created {
+			if cleanupErr := c.deleteResource(endpoint); cleanupErr != nil && err == nil {
+				err = fmt.Errorf("cleanup: %v", cleanupErr)
+			}
+		}
+		// Once the originals are gone the names can only refer to re-created,
+		// now deleted, resources
+		if originalsDeleted {
+			delete(c.TemplateIDs, templateName)
+			delete(c.TemplateSources, templateName)
+			delete(c.PolicyIDs, policyName)
+			delete(c.PolicyTemplates, policyName)
+		}
+	}()
+	if err := c.deleteResource("/api/policies/" + c.PolicyIDs[policyName]); err != nil {
+		return err
+	}
+	delete(c.PolicyIDs, policyName)
+	delete(c.PolicyTemplates, policyName)
+	if err := c.deleteResource("/api/rule-templates/" + templateID); err != nil {
+		return err
+	}
+	originalsDeleted = true
+
+	if err := c.createTemplate(templateName, source); err != nil {
+		return err
+	}
+	if c.Resp.StatusCode != http.StatusCreated {
+		return fmt.Errorf("re-creating template '%s' returned status %d", templateName, c.Resp.StatusCode)
+	}
+	created = append(created, "/api/rule-templates/"+c.TemplateIDs[templateName])
+	if err := c.aPolicyExists(policyName, templateName); err != nil {
+		return err
+	}
+	if c.Resp.StatusCode != http.StatusCreated {
+		return fmt.Errorf("re-creating policy '%s' returned status %d", policyName, c.Resp.StatusCode)
+	}
+	created = append(created, "/api/policies/"+c.PolicyIDs[policyName])
+
+	if err := c.executePolicy(policyName, docstring.Content, nil); err != nil {
+		return err
+	}
+	output, err := c.outputFacts()
+	if err != nil {
+		return fmt.Errorf("execution after re-creation: %v", err)
+	}
+	if diff := jsonDiff(baseline, output); diff != "" {
+		return fmt.Errorf("re-creating template '%s' changed the output of policy '%s':\n%s", templateName, policyName, diff)
+	}
+	return nil
+}
+
+// executePolicy posts facts to /api/execute for a stored policy. Options are
+// merged into the request payload alongside policy_id and facts.
+func (c *apiContext) executePolicy(name, factsJSON string, options map[string]interface{}) error {
+	policyID, ok := c.PolicyIDs[name]
+	if !ok {
+		return fmt.Errorf("policy '%s' not found", name)
+	}
+
+	// Facts are decoded like responses so they compare equal to output facts
+	var facts interface{}
+	dec := json.NewDecoder(strings.NewReader(factsJSON))
+	if c.ExactNumbers {
+		dec.UseNumber()
+	}
+	if err := dec.Decode(&facts); err != nil {
+		return err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return fmt.Errorf("facts must be a single JSON value, found trailing data")
+	}
+
+	// The facts are sent as written, keeping their key order; the strict
+	// decode above guarantees they marshal as a single JSON value
+	payload := map[string]interface{}{
+		"policy_id": policyID,
+		"facts":     json.RawMessage(factsJSON),
+	}
+	for k, v := range options {
+		payload[k] = v
+	}
+	c.LastFacts = facts
+	return c.sendPostRequest("/api/execute", payload)
+}
+
+// iExecutePipelineOfPolicies runs comma-separated policies in order, each
+// receiving the previous one's output. The response carries the final result,
+// so the usual output steps apply to it.
+func (c *apiContext) iExecutePipelineOfPolicies(names string, docstring *godog.DocString) error {
+	var ids []string
+	var unknown []string
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		id, ok := c.PolicyIDs[name]
+		if !ok {
+			unknown = append(unknown, name)
+			continue
+		}
+		ids = append(ids, id)
+	}
+	if len(unknown) > 0 {
+		return fmt.Errorf("policies not found: %s", strings.Join(unknown, ", "))
+	}
+	if !json.Valid([]byte(docstring.Content)) {
+		return fmt.Errorf("facts are not valid JSON")
+	}
+	payload := map[string]interface{}{
+		"policy_ids": ids,
+		"facts":      json.RawMessage(docstring.Content),
+	}
+	return c.sendPostRequest("/api/execute-pipeline", payload)
+}
+
+// policiesOnBothEnginesShouldAgree executes each comma-separated policy against
+// both engines and compares their output facts. The engines must share storage,
+// since policies are resolved to the same ID on both.
+func (c *apiContext) policiesOnBothEnginesShouldAgree(names string, docstring *godog.DocString) error {
+	if c.SecondaryURL == "" {
+		// Fails with the configuration hint before anything runs on the primary
+		return c.onSecondaryEngine(nil)
+	}
+	var disagreements []string
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		var outputs [2]interface{}
+		for i, engine := range []string{"primary", "secondary"} {
+			run := func() error {
+				if err := c.executePolicy(name, docstring.Content, nil); err != nil {
+					return err
+				}
+				if c.Resp.StatusCode != http.StatusOK {
+					return fmt.Errorf("executing policy '%s' on the %s engine returned status %d: %v", name, engine, c.Resp.StatusCode, c.ResponseBody)
+				}
+				output, err := c.outputFacts()
+				outputs[i] = output
+				return err
+			}
+			var err error
+			if engine == "secondary" {
+				err = c.onSecondaryEngine(run)
+			} else {
+				err = run()
+			}
+			if err != nil {
+				return err
+			}
+		}
+		if diff := jsonDiff(outputs[0], outputs[1]); diff != "" {
+			disagreements = append(disagreements, fmt.Sprintf("policy '%s' (primary vs secondary):\n%s", name, diff))
+		}
+	}
+	if len(disagreements) > 0 {
+		return fmt.Errorf("engines disagree on %d policies:\n%s", len(disagreements), strings.Join(disagreements, "\n"))
+	}
+	return nil
+}
+
+// Helpers
+
+var varReference = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// expandVars replaces ${name} with a saved variable, falling back to the
+// environment. Bare $ signs, as in "$5" or "?$top=5", are left alone, and a
+// name that is neither saved nor set is an error rather than an empty string.
+func (c *apiContext) expandVars(s string) (string, error) {
+	var unknown []string
+	expanded := varReference.ReplaceAllStringFunc(s, func(ref string) string {
+		name := varReference.FindStringSubmatch(ref)[1]
+		if val, ok := c.Vars[name]; ok {
+			return val
+		}
+		if val, ok := os.LookupEnv(name); ok {
+			return val
+		}
+		unknown = append(unknown, name)
+		return ref
+	})
+	if len(unknown) > 0 {
+		return "", fmt.Errorf("undefined variables: %s", strings.Join(unknown, ", "))
+	}
+	return expanded, nil
+}
+
+// newRequest builds a request against BaseURL carrying the default headers and
+// a request ID, which is freshly generated unless pinned by the scenario.
+func (c *apiContext) newRequest(method, endpoint string, payload []byte) (*http.Request, error) {
+	var body io.Reader
+	if payload != nil {
+		body = bytes.NewReader(payload)
+	}
+	req, err := http.NewRequest(method, c.BaseURL+endpoint, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", userAgent)
+	for k, v := range c.Headers {
+		req.Header.Set(k, v)
+	}
+	requestID := c.RequestID
+	if requestID == "" {
+		requestID = uuid.NewString()
+	}
+	req.Header.Set("X-Request-ID", requestID)
+	c.Requests = append(c.Requests, method+" "+endpoint)
+	if debug {
+		fmt.Fprintf(os.Stderr, "[godog] %s %s X-Request-ID=%s\n", method, req.URL, requestID)
+	}
+	for _, cookie := range c.Cookies {
+		req.AddCookie(cookie)
+	}
+	return req, nil
+}
+
+// resolveEndpoint expands saved variables in endpoint, e.g. "${location}", and
+// returns it with the path to request. A saved absolute URL on the API host or
+// a path that already carries APIPrefix, as in a Location header, is used as
+// is; anything else gets the prefix.
+func (c *apiContext) resolveEndpoint(endpoint string) (expanded, path string, err error) {
+	expanded, err = c.expandVars(endpoint)
+	if err != nil {
+		return "", "", err
+	}
+	switch {
+	case strings.HasPrefix(expanded, c.BaseURL+"/"):
+		path = strings.TrimPrefix(expanded, c.BaseURL)
+	case c.APIPrefix != "" && strings.HasPrefix(expanded, c.APIPrefix+"/"):
+		path = expanded
+	default:
+		path = c.APIPrefix + expanded
+	}
+	return expanded, path, nil
+}
+
+// sendRequest sends an API call, prefixing the endpoint with APIPrefix, and
+// parses the JSON response. Headers are applied on top of the default headers.
+func (c *apiContext) sendRequest(method, endpoint string, payload []byte, headers map[string]string) error {
+	endpoint, path, err := c.resolveEndpoint(endpoint)
+	if err != nil {
+		return err
+	}
+	if c.RequestSpec != "" && payload != nil && headers["Content-Encoding"] == "" &&
+		strings.HasPrefix(headers["Content-Type"], "application/json") {
+		if err := c.validateRequestBody(method, path, payload); err != nil {
+			return err
+		}
+	}
+	req, err := c.newRequest(method, path, payload)
+	if err != nil {
+		return err
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	c.LastRequest = &sentRequest{Method: method, Endpoint: endpoint, Payload: payload, Headers: headers}
+	resp, err := client.Do(req)
+	if err != nil {
+		c.Resp = nil
+		c.traceExchange(req, payload, err)
+		return err
+	}
+	c.Resp = resp
+	err = c.parseBody()
+	c.traceExchange(req, payload, err)
+	return err
+}
+
+// sendRejectableRequest is sendRequest for steps whose body the server may
+// refuse. Error responses are often plain text or HTML (e.g. a body-limit 413),
+// so a body that fails to decode is kept only in RawBody instead of failing
+// the step before its status is asserted.
+func (c *apiContext) sendRejectableRequest(method, endpoint string, payload []byte, headers map[string]string) error {
+	// Tells a response that failed to decode from an error before one arrived
+	c.Resp = nil
+	err := c.sendRequest(method, endpoint, payload, headers)
+	if c.Resp == nil || c.Resp.StatusCode < 400 {
+		return err
+	}
+	return nil
+}
+
+// traceExchange traces a request whose response is the one under test.
+func (c *apiContext) traceExchange(req *http.Request, payload []byte, err error) {
+	c.traceRoundTrip(req, payload, c.Resp, c.RawBody, err)
+}
+
+// doDirect sends req and reads the whole response without touching the
+// response under test, for lookups made on a step's behalf such as the health
+// check. The exchange is still traced.
+func (c *apiContext) doDirect(req *http.Request) (*http.Response, []byte, error) {
+	resp, err := client.Do(req)
+	if err != nil {
+		c.traceRoundTrip(req, nil, nil, nil, err)
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	c.traceRoundTrip(req, nil, resp, body, err)
+	return resp, body, err
+}
+
+// traceRoundTrip appends a request and its response, or the error that
+// prevented one, to the scenario transcript when GODOG_TRACE_DIR is set.
+func (c *apiContext) traceRoundTrip(req *http.Request, payload []byte, resp *http.Response, body []byte, err error) {
+	if c.Transcript == nil {
+		return
+	}
+	t := c.Transcript
+	fmt.Fprintf(t, "> %s %s\n", req.Method, req.URL)
+	writeTraceHeaders(t, ">", req.Header)
+	writeTraceBody(t, req.Header, payload)
+	if resp == nil {
+		fmt.Fprintf(t, "! %v\n\n", err)
+		return
+	}
+	fmt.Fprintf(t, "< %s %s\n", resp.Proto, resp.Status)
+	writeTraceHeaders(t, "<", resp.Header)
+	writeTraceBody(t, resp.Header, body)
+	if err != nil {
+		fmt.Fprintf(t, "! %v\n", err)
+	}
+	t.WriteString("\n")
+}
+
+// Headers carrying credentials: the auth set from an environment profile,
+// cookies in both directions, and custom key or token headers.
+var (
+	traceRedacted = map[string]bool{
+		"Authorization":       true,
+		"Proxy-Authorization": true,
+		"Cookie":              true,
+		"Set-Cookie":          true,
+	}
+	traceSecretHeader = regexp.MustCompile(`(?i)token|secret|password|api-?key`)
+)
+
+func writeTraceHeaders(w io.Writer, prefix string, header http.Header) {
+	names := make([]string, 0, len(header))
+	for name := range header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		value := strings.Join(header[name], ", ")
+		// Transcripts end up as CI artifacts, so credentials are not written out
+		if traceRedacted[name] || traceSecretHeader.MatchString(name) {
+			value = "[redacted]"
+		}
+		fmt.Fprintf(w, "%s %s: %s\n", prefix, name, value)
+	}
+}
+
+func writeTraceBody(w io.Writer, header http.Header, body []byte) {
+	switch {
+	case len(body) == 0:
+	case header.Get("Content-Encoding") != "":
+		fmt.Fprintf(w, "\n(%d bytes, %s-encoded)\n", len(body), header.Get("Content-Encoding"))
+	case !isTextContent(header.Get("Content-Type")):
+		fmt.Fprintf(w, "\n(%d bytes of %s)\n", len(body), header.Get("Content-Type"))
+	default:
+		fmt.Fprintf(w, "\n%s\n", bytes.TrimRight(body, "\n"))
+	}
+}
+
+// isTextContent reports whether a body is safe to write to a transcript as is.
+// A missing Content-Type counts as text, as for bodiless GETs.
+func isTextContent(contentType string) bool {
+	return contentType == "" || strings.HasPrefix(contentType, "text/") || strings.Contains(contentType, "json")
+}
+
+var traceFileUnsafe = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// writeTranscript saves the scenario transcript as <feature>-<scenario>.log in
+// GODOG_TRACE_DIR, with -2, -3, ... appended to repeated names. Failures are
+// only reported, so tracing never fails a test.
+func (c *apiContext) writeTranscript(sc *godog.Scenario, scenarioErr error) {
+	if c.Transcript == nil {
+		return
+	}
+	if errors.Is(scenarioErr, godog.ErrSkip) {
+		c.Transcript.WriteString("# Result: skipped\n")
+	} else if scenarioErr != nil {
+		fmt.Fprintf(c.Transcript, "# Result: failed: %v\n", scenarioErr)
+	} else {
+		c.Transcript.WriteString("# Result: passed\n")
+	}
+	feature := strings.TrimSuffix(filepath.Base(sc.Uri), filepath.Ext(sc.Uri))
+	name := strings.Trim(traceFileUnsafe.ReplaceAllString(feature+"-"+sc.Name, "_"), "_")
+	traceMu.Lock()
+	traceNames[name]++
+	if n := traceNames[name]; n > 1 {
+		name = fmt.Sprintf("%s-%d", name, n)
+	}
+	traceMu.Unlock()
+	path := filepath.Join(traceDir, name+".log")
+	if err := os.WriteFile(path, c.Transcript.Bytes(), 0o644); err != nil {
+		fmt.Fprintf(os.Stderr, "WARNING: failed to write transcript '%s': %v\n", path, err)
+	}
+}
+
+// deleteResource sends a DELETE and treats an already missing resource as deleted.
+func (c *apiContext) deleteResource(endpoint string) error {
+	err := c.sendRequest(http.MethodDelete, endpoint, nil, nil)
+	if c.Resp == nil {
+		return err
+	}
+	if c.Resp.StatusCode == http.StatusNotFound || (c.Resp.StatusCode >= 200 && c.Resp.StatusCode < 300) {
+		return nil
+	}
+	return fmt.Errorf("DELETE %s returned status %d", endpoint, c.Resp.StatusCode)
+}
+
+func (c *apiContext) sendPostRequest(endpoint string, payload interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("cannot encode request body for %s: %v", endpoint, err)
+	}
+	if err := c.sendRequest(http.MethodPost, endpoint, body, map[string]string{"Content-Type": "application/json"}); err != nil {
+		return err
+	}
+
+	// Store IDs if present; IDField may be nested and the ID numeric
+	if raw, err := lookupPath(c.ResponseBody, c.IDField); err == nil && raw != nil {
+		id := jsonScalarString(raw)
+		if name := payloadString(payload, "name"); name != "" {
+			if strings.Contains(endpoint, "policies") {
+				c.PolicyIDs[name] = id
+			} else {
+				c.TemplateIDs[name] = id
+				c.TemplateSources[name] = payloadString(payload, "source")
+			}
+		}
+	}
+	return nil
+}
+
+func (c *apiContext) sendPatchRequest(endpoint string, payload interface{}) error {
+	body, _ := json.Marshal(payload)
+	return c.sendRequest(http.MethodPatch, endpoint, body, map[string]string{"Content-Type": "application/json"})
+}
+
+// payloadString reads a string field from either payload map type.
+func payloadString(payload interface{}, key string) string {
+	switch p := payload.(type) {
+	case map[string]interface{}:
+		s, _ := p[key].(string)
+		return s
+	case map[string]string:
+		return p[key]
+	}
+	return ""
+}
+
+// lookupPath walks a dotted path such as "totals.net" or "items.0.id" through
+// decoded JSON, naming the exact segment that could not be resolved.
+func lookupPath(root interface{}, path string) (interface{}, error) {
+	current := root
+	segments := strings.Split(path, ".")
+	for i, seg := range segments {
+		parent := strings.Join(segments[:i], ".")
+		if parent == "" {
+			parent = "(root)"
+		}
+		switch node := current.(type) {
+		case map[string]interface{}:
+			val, ok := node[seg]
+			if !ok {
+				return nil, fmt.Errorf("path '%s': segment '%s' not found in %s", path, seg, parent)
+			}
+			current = val
+		case []interface{}:
+			idx, err := strconv.Atoi(seg)
+			if err != nil || idx < 0 || idx >= len(node) {
+				return nil, fmt.Errorf("path '%s': segment '%s' is not a valid index into %s (length %d)", path, seg, parent, len(node))
+			}
+			current = node[idx]
+		default:
+			return nil, fmt.Errorf("path '%s': cannot read segment '%s', %s is %T", path, seg, parent, current)
+		}
+	}
+	return current, nil
+}
+
+func (c *apiContext) outputFacts() (interface{}, error) {
+	bodyMap, ok := c.ResponseBody.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("response is not an object")
+	}
+	output, ok := bodyMap["output_facts"]
+	if !ok {
+		return nil, fmt.Errorf("output_facts not found")
+	}
+	return output, nil
+}
+
+// outputField resolves a dotted path under output_facts of an execution response.
+func (c *apiContext) outputField(path string) (interface{}, error) {
+	output, err := c.outputFacts()
+	if err != nil {
+		return nil, err
+	}
+	return lookupPath(output, path)
+}
+
+// jsonDiff renders a colorized diff of two decoded JSON values showing only
+// what differs, or "" when they are equal.
+func jsonDiff(expected, actual interface{}) string {
+	a, errA := json.Marshal(expected)
+	b, errB := json.Marshal(actual)
+	if errA != nil || errB != nil {
+		return fmt.Sprintf("expected %v, got %v", expected, actual)
+	}
+	opts := jsondiff.DefaultConsoleOptions()
+	opts.SkipMatches = true
+	if diff, text := jsondiff.Compare(a, b, &opts); diff != jsondiff.FullMatch {
+		return text
+	}
+	return ""
+}
+
+func (c *apiContext) responseList() ([]interface{}, error) {
+	list, ok := c.ResponseBody.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("response is not a list, got %T", c.ResponseBody)
+	}
+	return list, nil
+}
+
+// listItemsWhere returns the response list items whose field, compared in its
+// string form, equals value.
+func (c *apiContext) listItemsWhere(field, value string) ([]interface{}, error) {
+	list, err := c.responseList()
+	if err != nil {
+		return nil, err
+	}
+	var matches []interface{}
+	for _, item := range list {
+		val, err := lookupPath(item, field)
+		if err != nil {
+			continue
+		}
+		if jsonScalarString(val) == value {
+			matches = append(matches, item)
+		}
+	}
+	return matches, nil
+}
+
+// responseErrorMessage joins the "error" and "message" fields used by both API
+// error responses and failed executions.
+func (c *apiContext) responseErrorMessage() string {
+	bodyMap, _ := c.ResponseBody.(map[string]interface{})
+	var parts []string
+	for _, key := range []string{"error", "message"} {
+		if msg, ok := bodyMap[key].(string); ok && msg != "" {
+			parts = append(parts, msg)
+		}
+	}
+	return strings.Join(parts, ": ")
+}
+
+// firedRules reads the rule names from the fired_rules array of an execution
+// response. Entries may be plain names or objects carrying a "name" field.
+func (c *apiContext) firedRules() ([]string, error) {
+	bodyMap, ok := c.ResponseBody.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("response is not an object")
+	}
+	list, ok := bodyMap["fired_rules"].([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("fired_rules not found or not a list: %v", c.ResponseBody)
+	}
+	rules := make([]string, 0, len(list))
+	for i, item := range list {
+		switch rule := item.(type) {
+		case string:
+			rules = append(rules, rule)
+		case map[string]interface{}:
+			name, ok := rule["name"].(string)
+			if !ok {
+				return nil, fmt.Errorf("fired_rules[%d] has no name: %v", i, rule)
+			}
+			rules = append(rules, name)
+		default:
+			return nil, fmt.Errorf("fired_rules[%d] is not a rule name: %v", i, item)
+		}
+	}
+	return rules, nil
+}
+
+// canonicalJSON marshals v with object keys sorted at every level.
+func canonicalJSON(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := writeCanonicalJSON(&buf, v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func writeCanonicalJSON(buf *bytes.Buffer, v interface{}) error {
+	switch val := v.(type) {
+	case map[string]interface{}:
+		keys := make([]string, 0, len(val))
+		for k := range val {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		buf.WriteByte('{')
+		for i, k := range keys {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			key, _ := json.Marshal(k)
+			buf.Write(key)
+			buf.WriteByte(':')
+			if err := writeCanonicalJSON(buf, val[k]); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('}')
+	case []interface{}:
+		buf.WriteByte('[')
+		for i, item := range val {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			if err := writeCanonicalJSON(buf, item); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte(']')
+	default:
+		b, err := json.Marshal(val)
+		if err != nil {
+			return err
+		}
+		buf.Write(b)
+	}
+	return nil
+}
+
+func (c *apiContext) parseBody() error {
+	defer c.Resp.Body.Close()
+	c.ResponseBody = nil
+	c.RawBody = nil
+	// HEAD responses have no body
+	if c.Resp.Request.Method == http.MethodHead {
+		return nil
+	}
+	// Reading to EOF also populates trailers
+	raw, err := io.ReadAll(c.Resp.Body)
+	if err != nil {
+		return err
+	}
+	c.RawBody = raw
+	// Redirects are only inspected via their headers
+	if c.Resp.StatusCode >= 300 && c.Resp.StatusCode < 400 {
+		return nil
+	}
+	c.ResponseBody, err = c.decodeBody(c.ExactNumbers)
+	return err
+}
+
+// decodeBody decodes RawBody, keeping numbers as json.Number when useNumber is
+// set. An empty body (e.g. a bare 404) decodes to nil.
+func (c *apiContext) decodeBody(useNumber bool) (interface{}, error) {
+	// The transport only decompresses transparently when it asked for gzip
+	// itself, so a gzip Content-Encoding here means the body is still compressed
+	var body io.Reader = bytes.NewReader(c.RawBody)
+	if c.Resp.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(body)
+		if err != nil {
+			return nil, fmt.Errorf("invalid gzip response body: %v", err)
+		}
+		defer gz.Close()
+		body = gz
+	}
+	dec := json.NewDecoder(body)
+	if useNumber {
+		dec.UseNumber()
+	}
+	var v interface{}
+	if err := dec.Decode(&v); err != nil && err != io.EOF {
+		return nil, err
+	}
+	return v, nil
+}
+
+// jsonScalarString formats a decoded JSON value the way it appears in the
+// document, so large numbers don't turn into exponent notation as with
+// fmt.Sprint (1234567 rather than 1.234567e+06).
+func jsonScalarString(v interface{}) string {
+	if f, ok := v.(float64); ok {
+		return strconv.FormatFloat(f, 'f', -1, 64)
+	}
+	return fmt.Sprint(v)
+}
+
+// toFloat accepts numbers decoded in either mode.
+func toFloat(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case json.Number:
+		f, err := n.Float64()
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// Assertions
+
+func (c *apiContext) theResponseStatusShouldBe(code int) error {
+	if c.Resp.StatusCode != code {
+		return fmt.Errorf("expected status %d, got %d", code, c.Resp.StatusCode)
+	}
+	return nil
+}
+
+func (c *apiContext) theResponseStatusShouldNotBe(code int) error {
+	if c.Resp.StatusCode == code {
+		return fmt.Errorf("expected status not to be %d, got %d", code, c.Resp.StatusCode)
+	}
+	return nil
+}
+
+func (c *apiContext) theResponseTrailerShouldBe(name, value string) error {
+	got, ok := c.Resp.Trailer[http.CanonicalHeaderKey(name)]
+	if !ok {
+		return fmt.Errorf("response trailer '%s' not set (trailers: %v)", name, c.Resp.Trailer)
+	}
+	if strings.Join(got, ", ") != value {
+		return fmt.Errorf("expected trailer '%s' to be '%s', got '%s'", name, value, strings.Join(got, ", "))
+	}
+	return nil
+}
+
+// Content-Length counts the bytes on the wire, so it is compared against the
+// body before any gzip decoding. After a HEAD it is only checked to be valid.
+func (c *apiContext) theContentLengthHeaderShouldMatchTheBodySize() error {
+	header := c.Resp.Header.Get("Content-Length")
+	if header == "" {
+		fmt.Fprintf(os.Stderr, "NOTE: no Content-Length header on %s response (transfer encoding: %v), size check skipped\n", c.Resp.Request.URL.Path, c.Resp.TransferEncoding)
+		return nil
+	}
+	length, err := strconv.Atoi(header)
+	if err != nil || length < 0 {
+		return fmt.Errorf("invalid Content-Length '%s'", header)
+	}
+	// A HEAD response announces the GET body's length without sending it
+	if c.Resp.Request.Method == http.MethodHead {
+		return nil
+	}
+	if length != len(c.RawBody) {
+		return fmt.Errorf("expected a %d byte body per Content-Length, got %d bytes", length, len(c.RawBody))
+	}
+	return nil
+}
+
+// parseCacheControl maps each Cache-Control directive (lowercased) to its
+// unquoted value, or "" for bare directives like no-store.
+func parseCacheControl(header string) map[string]string {
+	directives := make(map[string]string)
+	for _, part := range strings.Split(header, ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+		if name == "" {
+			continue
+		}
+		directives[strings.ToLower(name)] = strings.Trim(value, `"`)
+	}
+	return directives
+}
+
+// theResponseShouldBeCacheableForAtLeast prefers s-maxage over max-age, as a
+// shared cache such as a CDN does.
+func (c *apiContext) theResponseShouldBeCacheableForAtLeast(seconds int) error {
+	header := c.Resp.Header.Get("Cache-Control")
+	directives := parseCacheControl(header)
+	for _, d := range []string{"no-store", "no-cache", "private"} {
+		if _, ok := directives[d]; ok {
+			return fmt.Errorf("expected a cacheable response, got Cache-Control '%s'", header)
+		}
+	}
+	value, ok := directives["s-maxage"]
+	if !ok {
+		value, ok = directives["max-age"]
+	}
+	if !ok {
+		return fmt.Errorf("no max-age in Cache-Control '%s'", header)
+	}
+	maxAge, err := strconv.Atoi(value)
+	if err != nil {
+		return fmt.Errorf("invalid max-age '%s' in Cache-Control '%s'", value, header)
+	}
+	if maxAge < seconds {
+		return fmt.Errorf("expected the response to be cacheable for at least %d seconds, got %d", seconds, maxAge)
+	}
+	return nil
+}
+
+func (c *apiContext) theResponseShouldNotBeCacheable() error {
+	header := c.Resp.Header.Get("Cache-Control")
+	directives := parseCacheControl(header)
+	_, noStore := directives["no-store"]
+	_, noCache := directives["no-cache"]
+	if !noStore && !noCache {
+		return fmt.Errorf("expected Cache-Control to contain no-store or no-cache, got '%s'", header)
+	}
+	return nil
+}
+
+// theResponseShouldBeACache matches X-Cache by prefix, since caches often
+// append details such as "HIT from edge-1".
+func (c *apiContext) theResponseShouldBeACache(status string) error {
+	header := c.Resp.Header.Get("X-Cache")
+	if header == "" {
+		return fmt.Errorf("response has no X-Cache header")
+	}
+	if !strings.HasPrefix(strings.ToUpper(header), status) {
+		return fmt.Errorf("expected a cache %s, got X-Cache '%s'", status, header)
+	}
+	return nil
+}
+
+func (c *apiContext) theDownloadedFileShouldBeAtLeastBytes(size int) error {
+	if len(c.RawBody) < size {
+		return fmt.Errorf("expected the downloaded file to be at least %d bytes, got %d", size, len(c.RawBody))
+	}
+	return nil
+}
+
+// theDownloadedFileShouldStartWithBytes checks a magic number given in hex,
+// e.g. "25504446" for a PDF; spaces between bytes are allowed.
+func (c *apiContext) theDownloadedFileShouldStartWithBytes(hexPrefix string) error {
+	prefix, err := hex.DecodeString(strings.ReplaceAll(hexPrefix, " ", ""))
+	if err != nil {
+		return fmt.Errorf("invalid hex '%s': %v", hexPrefix, err)
+	}
+	if !bytes.HasPrefix(c.RawBody, prefix) {
+		head := c.RawBody
+		if len(head) > len(prefix) {
+			head = head[:len(prefix)]
+		}
+		return fmt.Errorf("expected the downloaded file to start with %x, got %x", prefix, head)
+	}
+	return nil
+}
+
+func (c *apiContext) theResponseShouldBeGzipEncoded() error {
+	if got := c.Resp.Header.Get("Content-Encoding"); got != "gzip" {
+		return fmt.Errorf("expected Content-Encoding 'gzip', got '%s'", got)
+	}
+	return nil
+}
+
+func (c *apiContext) theResponseShouldUseHTTP2() error {
+	if c.Resp.ProtoMajor != 2 {
+		return fmt.Errorf("expected an HTTP/2 response, got %s", c.Resp.Proto)
+	}
+	return nil
+}
+
+func (c *apiContext) theResponseProtocolShouldBe(proto string) error {
+	if c.Resp.Proto != proto {
+		return fmt.Errorf("expected protocol '%s', got '%s'", proto, c.Resp.Proto)
+	}
+	return nil
+}
+
+func (c *apiContext) responseCookie(name string) (*http.Cookie, error) {
+	for _, cookie := range c.Resp.Cookies() {
+		if cookie.Name == name {
+			return cookie, nil
+		}
+	}
+	return nil, fmt.Errorf("response did not set cookie '%s'", name)
+}
+
+func (c *apiContext) theCookieShouldBeHttpOnly(name string) error {
+	cookie, err := c.responseCookie(name)
+	if err != nil {
+		return err
+	}
+	if !cookie.HttpOnly {
+		return fmt.Errorf("expected cookie '%s' to be HttpOnly, got: %s", name, cookie.String())
+	}
+	return nil
+}
+
+var sameSiteModes = map[string]http.SameSite{
+	"strict": http.SameSiteStrictMode,
+	"lax":    http.SameSiteLaxMode,
+	"none":   http.SameSiteNoneMode,
+}
+
+func (c *apiContext) theCookieShouldHaveSameSite(name, mode string) error {
+	expected, ok := sameSiteModes[strings.ToLower(mode)]
+	if !ok {
+		return fmt.Errorf("unknown SameSite mode '%s', expected Strict, Lax or None", mode)
+	}
+	cookie, err := c.responseCookie(name)
+	if err != nil {
+		return err
+	}
+	if cookie.SameSite != expected {
+		return fmt.Errorf("expected cookie '%s' to have SameSite=%s, got: %s", name, mode, cookie.String())
+	}
+	return nil
+}
+
+func (c *apiContext) theResponseShouldAllowOrigin(origin string) error {
+	got := c.Resp.Header.Get("Access-Control-Allow-Origin")
+	if got != origin && got != "*" {
+		return fmt.Errorf("expected Access-Control-Allow-Origin to allow '%s', got '%s'", origin, got)
+	}
+	return nil
+}
+
+func (c *apiContext) theAPIVersionShouldBeAtLeast(minimum string) error {
+	required, err := semver.NewVersion(minimum)
+	if err != nil {
+		return fmt.Errorf("invalid required version '%s': %v", minimum, err)
+	}
+	header := c.Resp.Header.Get("X-API-Version")
+	if header == "" {
+		return fmt.Errorf("response has no X-API-Version header")
+	}
+	actual, err := semver.NewVersion(header)
+	if err != nil {
+		return fmt.Errorf("X-API-Version '%s' is not a semantic version: %v", header, err)
+	}
+	if actual.LessThan(required) {
+		return fmt.Errorf("expected API version at least %s, got %s", required, actual)
+	}
+	return nil
+}
+
+func (c *apiContext) theResponseShouldContain(text string) error {
+	bodyBytes, _ := json.Marshal(c.ResponseBody)
+	if !strings.Contains(string(bodyBytes), text) {
+		return fmt.Errorf("response body does not contain '%s'", text)
+	}
+	return nil
+}
+
+func (c *apiContext) theResponseShouldMatchPattern(pattern string) error {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return fmt.Errorf("invalid pattern '%s': %v", pattern, err)
+	}
+	bodyBytes, _ := json.Marshal(c.ResponseBody)
+	if !re.Match(bodyBytes) {
+		snippet := string(bodyBytes)
+		if len(snippet) > 200 {
+			snippet = snippet[:200] + "..."
+		}
+		return fmt.Errorf("response body does not match pattern '%s': %s", pattern, snippet)
+	}
+	return nil
+}
+
+func (c *apiContext) theResponseFieldShouldBe(field string, value int) error {
+	bodyMap, ok := c.ResponseBody.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("response is not an object")
+	}
+	val, ok := toFloat(bodyMap[field])
+	if !ok {
+		return fmt.Errorf("field '%s' not found or not a number", field)
+	}
+	if int(val) != value {
+		return fmt.Errorf("expected field '%s' to be %d, got %d", field, value, int(val))
+	}
+	return nil
+}
+
+// theResponseFieldShouldExactlyBe compares the number as written in the body,
+// so 64-bit integers are not rounded through float64.
+func (c *apiContext) theResponseFieldShouldExactlyBe(field, value string) error {
+	body, err := c.decodeBody(true)
+	if err != nil {
+		return err
+	}
+	raw, err := lookupPath(body, field)
+	if err != nil {
+		return err
+	}
+	num, ok := raw.(json.Number)
+	if !ok {
+		return fmt.Errorf("field '%s' is not a number: %v", field, raw)
+	}
+	if num.String() != value {
+		return fmt.Errorf("expected field '%s' to be exactly %s, got %s", field, value, num)
+	}
+	return nil
+}
+
+func (c *apiContext) theOutputFieldShouldBe(field string, value int) error {
+	raw, err := c.outputField(field)
+	if err != nil {
+		return err
+	}
+	val, ok := toFloat(raw)
+	if !ok {
+		return fmt.Errorf("output field '%s' is not a number: %v", field, raw)
+	}
+	if int(val) != value {
+		return fmt.Errorf("expected output field '%s' to be %d, got %d", field, value, int(val))
+	}
+	return nil
+}
+
+func (c *apiContext) theOutputFieldShouldBeBetween(field string, min, max int) error {
+	raw, err := c.outputField(field)
+	if err != nil {
+		return err
+	}
+	val, ok := toFloat(raw)
+	if !ok {
+		return fmt.Errorf("output field '%s' is not a number: %v", field, raw)
+	}
+	if val < float64(min) || val > float64(max) {
+		return fmt.Errorf("expected output field '%s' to be between %d and %d, got %v", field, min, max, val)
+	}
+	return nil
+}
+
+func (c *apiContext) theOutputFieldShouldBeA(field, kind string) error {
+	raw, err := c.outputField(field)
+	if err != nil {
+		return err
+	}
+	if got := jsonType(raw); got != kind {
+		return fmt.Errorf("expected output field '%s' to be a %s, got %s: %v", field, kind, got, raw)
+	}
+	return nil
+}
+
+// jsonType names the JSON type of a decoded value.
+func jsonType(v interface{}) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case float64, json.Number:
+		return "number"
+	case string:
+		return "string"
+	case bool:
+		return "boolean"
+	case map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+func (c *apiContext) theOutputFactsShouldContainKey(key string) error {
+	_, err := c.outputField(key)
+	return err
+}
+
+func (c *apiContext) theOutputFactsShouldNotContainKey(key string) error {
+	if _, err := c.outputFacts(); err != nil {
+		return err
+	}
+	if val, err := c.outputField(key); err == nil {
+		return fmt.Errorf("expected output facts not to contain '%s', got %v", key, val)
+	}
+	return nil
+}
+
+func (c *apiContext) theOutputFactsShouldEqualTheInputFacts() error {
+	if c.LastFacts == nil {
+		return fmt.Errorf("no facts recorded, execute a policy first")
+	}
+	output, err := c.outputFacts()
+	if err != nil {
+		return err
+	}
+	if diff := jsonDiff(c.LastFacts, output); diff != "" {
+		return fmt.Errorf("output facts differ from the input facts:\n%s", diff)
+	}
+	return nil
+}
+
+func (c *apiContext) theExecutionShouldSucceed() error {
+	bodyMap, ok := c.ResponseBody.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("response is not an object")
+	}
+	if success, ok := bodyMap["success"].(bool); !ok || !success {
+		return fmt.Errorf("execution failed: %v", c.ResponseBody)
+	}
+	return nil
+}
+
+func (c *apiContext) theExecutionShouldReportAtLeastNRulesEvaluated(count int) error {
+	metrics, err := lookupPath(c.ResponseBody, "metrics")
+	if err != nil {
+		return fmt.Errorf("execution reported no metrics: %v", c.ResponseBody)
+	}
+	evaluated, err := c.responseNumber("metrics.rules_evaluated")
+	if err != nil {
+		return fmt.Errorf("%v (metrics: %v)", err, metrics)
+	}
+	if evaluated < float64(count) {
+		return fmt.Errorf("expected at least %d rules evaluated, got %v (metrics: %v)", count, evaluated, metrics)
+	}
+	return nil
+}
+
+// noMoreThanNRequestsShouldHaveBeenMade counts every request built in the
+// scenario so far, including those made inside composite steps.
+func (c *apiContext) noMoreThanNRequestsShouldHaveBeenMade(limit int) error {
+	if len(c.Requests) > limit {
+		return fmt.Errorf("expected no more than %d requests, made %d:\n  %s", limit, len(c.Requests), strings.Join(c.Requests, "\n  "))
+	}
+	return nil
+}
+
+// theReportedExecutionTimeShouldBeUnder checks the engine's own timing, which
+// excludes network and HTTP overhead.
+func (c *apiContext) theReportedExecutionTimeShouldBeUnder(ms int) error {
+	elapsed, err := c.responseNumber("execution_time_ms")
+	if err != nil {
+		return err
+	}
+	if elapsed >= float64(ms) {
+		return fmt.Errorf("expected execution time under %d ms, got %v ms", ms, elapsed)
+	}
+	return nil
+}
+
+func (c *apiContext) theConditionShouldBeMet() error {
+	bodyMap, ok := c.ResponseBody.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("response is not an object")
+	}
+	if met, ok := bodyMap["condition_met"].(bool); !ok || !met {
+		return fmt.Errorf("condition not met: %v", c.ResponseBody)
+	}
+	return nil
+}
+
+func (c *apiContext) theConditionShouldNotBeMet() error {
+	bodyMap, ok := c.ResponseBody.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("response is not an object")
+	}
+	if met, ok := bodyMap["condition_met"].(bool); !ok || met {
+		return fmt.Errorf("condition unexpectedly met: %v", c.ResponseBody)
+	}
+	return nil
+}
+
+func (c *apiContext) exactlyNRulesShouldHaveFired(count int) error {
+	rules, err := c.firedRules()
+	if err != nil {
+		return err
+	}
+	if len(rules) != count {
+		return fmt.Errorf("expected %d rules to fire, got %d: %v", count, len(rules), rules)
+	}
+	return nil
+}
+
+// onlyTheFirstMatchingRuleShouldFire checks short-circuiting in exclusive
+// policies: a single rule fired and, when named, it is the expected one.
+func (c *apiContext) onlyTheFirstMatchingRuleShouldFire(expected string) error {
+	rules, err := c.firedRules()
+	if err != nil {
+		return err
+	}
+	if len(rules) != 1 {
+		return fmt.Errorf("expected only the first matching rule to fire, got %d: %v", len(rules), rules)
+	}
+	if expected != "" && rules[0] != expected {
+		return fmt.Errorf("expected rule '%s' to fire first, got '%s'", expected, rules[0])
+	}
+	return nil
+}
+
+// theRulesShouldHaveFiredInOrder expects a single-column table, one rule name per row.
+func (c *apiContext) theRulesShouldHaveFiredInOrder(table *godog.Table) error {
+	rules, err := c.firedRules()
+	if err != nil {
+		return err
+	}
+	expected := make([]string, 0, len(table.Rows))
+	for _, row := range table.Rows {
+		expected = append(expected, row.Cells[0].Value)
+	}
+	for i, name := range expected {
+		if i >= len(rules) {
+			return fmt.Errorf("expected rule '%s' at position %d, but only %d rules fired: %v", name, i+1, len(rules), rules)
+		}
+		if rules[i] != name {
+			return fmt.Errorf("expected rule '%s' at position %d, got '%s': %v", name, i+1, rules[i], rules)
+		}
+	}
+	if len(rules) > len(expected) {
+		return fmt.Errorf("unexpected rule '%s' fired at position %d: %v", rules[len(expected)], len(expected)+1, rules)
+	}
+	return nil
+}
+
+// theTraceShouldInclude matches trace entries that are plain step names or
+// objects naming the step in a "step" or "name" field.
+func (c *apiContext) theTraceShouldInclude(step string) error {
+	if c.Trace == nil {
+		return fmt.Errorf("no trace recorded, execute a policy with tracing first")
+	}
+	for _, entry := range c.Trace {
+		switch e := entry.(type) {
+		case string:
+			if e == step {
+				return nil
+			}
+		case map[string]interface{}:
+			if e["step"] == step || e["name"] == step {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("trace does not include '%s': %v", step, c.Trace)
+}
+
+func (c *apiContext) theFieldShouldBeBool(field, value string) error {
+	raw, err := lookupPath(c.ResponseBody, field)
+	if err != nil {
+		return err
+	}
+	got, ok := raw.(bool)
+	if !ok {
+		return fmt.Errorf("field '%s' is not a boolean, got %T: %v", field, raw, raw)
+	}
+	if expected := value == "true"; got != expected {
+		return fmt.Errorf("expected field '%s' to be %s, got %t", field, value, got)
+	}
+	return nil
+}
+
+func (c *apiContext) theResponseFieldShouldBeNull(field string) error {
+	bodyMap, ok := c.ResponseBody.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("response is not an object")
+	}
+	val, ok := bodyMap[field]
+	if !ok {
+		return nil
+	}
+	if val != nil {
+		return fmt.Errorf("expected field '%s' to be null, got %v", field, val)
+	}
+	return nil
+}
+
+func (c *apiContext) theResponseShouldBeAList() error {
+	_, err := c.responseList()
+	return err
+}
+
+func (c *apiContext) theResponseShouldBeAnEmptyList() error {
+	list, err := c.responseList()
+	if err != nil {
+		return err
+	}
+	if len(list) != 0 {
+		return fmt.Errorf("expected an empty list, got %d items", len(list))
+	}
+	return nil
+}
+
+func (c *apiContext) theFieldShouldHaveDistinctValues(field string, count int) error {
+	list, err := c.responseList()
+	if err != nil {
+		return err
+	}
+	seen := map[string]bool{}
+	for i, item := range list {
+		val, err := lookupPath(item, field)
+		if err != nil {
+			return fmt.Errorf("item %d: %v", i, err)
+		}
+		// Normalize so 1 and "1" count as the same value
+		seen[fmt.Sprint(val)] = true
+	}
+	if len(seen) != count {
+		distinct := make([]string, 0, len(seen))
+		for v := range seen {
+			distinct = append(distinct, v)
+		}
+		sort.Strings(distinct)
+		return fmt.Errorf("expected %d distinct values of '%s', got %d: %v", count, field, len(seen), distinct)
+	}
+	return nil
+}
+
+// theEndpointShouldRequireAuthentication GETs the endpoint without the
+// Authorization header or explicit cookies, restoring both afterwards.
+func (c *apiContext) theEndpointShouldRequireAuthentication(endpoint string) error {
+	auth, hadAuth := c.Headers["Authorization"]
+	cookies := c.Cookies
+	delete(c.Headers, "Authorization")
+	c.Cookies = nil
+	defer func() {
+		if hadAuth {
+			c.Headers["Authorization"] = auth
+		}
+		c.Cookies = cookies
+	}()
+
+	err := c.iGet(endpoint)
+	if c.Resp == nil {
+		return err
+	}
+	if c.Resp.StatusCode != http.StatusUnauthorized && c.Resp.StatusCode != http.StatusForbidden {
+		return fmt.Errorf("expected '%s' to require authentication (401 or 403), got status %d", endpoint, c.Resp.StatusCode)
+	}
+	return nil
+}
+
+// methodToEndpointShouldNotBeAllowed expects a 405 whose Allow header lists
+// the permitted methods, without the rejected one.
+func (c *apiContext) methodToEndpointShouldNotBeAllowed(method, endpoint string) error {
+	method = strings.ToUpper(method)
+	err := c.sendRequest(method, endpoint, nil, nil)
+	if c.Resp == nil {
+		return err
+	}
+	if c.Resp.StatusCode != http.StatusMethodNotAllowed {
+		return fmt.Errorf("expected %s '%s' to be rejected with 405, got status %d", method, endpoint, c.Resp.StatusCode)
+	}
+	allow := c.Resp.Header.Get("Allow")
+	if allow == "" {
+		return fmt.Errorf("405 response for %s '%s' has no Allow header", method, endpoint)
+	}
+	for _, m := range strings.Split(allow, ",") {
+		if strings.EqualFold(strings.TrimSpace(m), method) {
+			return fmt.Errorf("expected Allow header '%s' not to list the rejected method %s", allow, method)
+		}
+	}
+	return nil
+}
+
+// thereShouldBeNRuleTemplates counts templates across pages when the list is
+// wrapped in an {"items": [...], "next": "..."} envelope. A next link that
+// revisits a page fails the step instead of looping forever.
+func (c *apiContext) thereShouldBeNRuleTemplates(count int) error {
+	endpoint := "/api/rule-templates"
+	total := 0
+	visited := make(map[string]bool)
+	for endpoint != "" {
+		if err := c.iGet(endpoint); err != nil {
+			return err
+		}
+		if c.Resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("listing rule templates returned status %d", c.Resp.StatusCode)
+		}
+		current := c.Resp.Request.URL
+		visited[current.String()] = true
+		switch body := c.ResponseBody.(type) {
+		case []interface{}:
+			total += len(body)
+			endpoint = ""
+		case map[string]interface{}:
+			items, ok := body["items"].([]interface{})
+			if !ok {
+				return fmt.Errorf("rule template list is not a list or paginated envelope: %v", body)
+			}
+			total += len(items)
+			next, _ := body["next"].(string)
+			if next == "" {
+				endpoint = ""
+				break
+			}
+			// next may be absolute, host-relative or relative to this page, e.g. "?page=2"
+			ref, err := url.Parse(next)
+			if err != nil {
+				return fmt.Errorf("invalid next link '%s': %v", next, err)
+			}
+			resolved := current.ResolveReference(ref).String()
+			if visited[resolved] {
+				return fmt.Errorf("pagination loops: next link '%s' points back to the already visited %s", next, resolved)
+			}
+			if !strings.HasPrefix(resolved, c.BaseURL+"/") {
+				return fmt.Errorf("next link '%s' leaves the API at %s", next, c.BaseURL)
+			}
+			endpoint = resolved
+		default:
+			return fmt.Errorf("rule template list is not a list, got %T", c.ResponseBody)
+		}
+	}
+	if total != count {
+		return fmt.Errorf("expected %d rule templates, got %d", count, total)
+	}
+	return nil
+}
+
+func (c *apiContext) policyShouldUseTemplate(policyName, templateName string) error {
+	policyID, ok := c.PolicyIDs[policyName]
+	if !ok {
+		return fmt.Errorf("policy '%s' not found", policyName)
+	}
+	templateID, ok := c.TemplateIDs[templateName]
+	if !ok {
+		return fmt.Errorf("template '%s' not found", templateName)
+	}
+	if err := c.iGet("/api/policies/" + policyID); err != nil {
+		return err
+	}
+	if c.Resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("fetching policy '%s' returned status %d", policyName, c.Resp.StatusCode)
+	}
+	bodyMap, ok := c.ResponseBody.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("response is not an object")
+	}
+	if got := bodyMap["rule_template_id"]; got != templateID {
+		return fmt.Errorf("expected policy '%s' to use template '%s' (%s), got %v", policyName, templateName, templateID, got)
+	}
+	return nil
+}
+
+func (c *apiContext) policyMetadataShouldBe(name, key, value string) error {
+	policyID, ok := c.PolicyIDs[name]
+	if !ok {
+		return fmt.Errorf("policy '%s' not found", name)
+	}
+	if err := c.iGet("/api/policies/" + policyID); err != nil {
+		return err
+	}
+	if c.Resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("fetching policy '%s' returned status %d", name, c.Resp.StatusCode)
+	}
+	metadata, err := lookupPath(c.ResponseBody, "metadata")
+	if err != nil {
+		return fmt.Errorf("policy '%s' has no metadata: %v", name, c.ResponseBody)
+	}
+	got, err := lookupPath(metadata, key)
+	if err != nil {
+		return fmt.Errorf("policy '%s' metadata: %v (metadata: %v)", name, err, metadata)
+	}
+	if jsonScalarString(got) != value {
+		return fmt.Errorf("expected policy '%s' metadata '%s' to be '%s', got '%v' (metadata: %v)", name, key, value, got, metadata)
+	}
+	return nil
+}
+
+// templateSourceShouldBeUnchanged compares the stored source with what was
+// sent at create time, ignoring line endings and trailing whitespace.
+func (c *apiContext) templateSourceShouldBeUnchanged(name string) error {
+	templateID, ok := c.TemplateIDs[name]
+	if !ok {
+		return fmt.Errorf("template '%s' not found", name)
+	}
+	sent, ok := c.TemplateSources[name]
+	if !ok || sent == "" {
+		return fmt.Errorf("no source recorded for template '%s'", name)
+	}
+	if err := c.iGet("/api/rule-templates/" + templateID); err != nil {
+		return err
+	}
+	if c.Resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("fetching template '%s' returned status %d", name, c.Resp.StatusCode)
+	}
+	stored, err := c.responseString("source")
+	if err != nil {
+		return err
+	}
+	want, got := normalizeSource(sent), normalizeSource(stored)
+	if want != got {
+		return fmt.Errorf("source of template '%s' changed:\n%s", name, unifiedDiff("sent", "stored", want, got))
+	}
+	return nil
+}
+
+func normalizeSource(source string) string {
+	lines := strings.Split(strings.ReplaceAll(source, "\r\n", "\n"), "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(line, " \t")
+	}
+	return strings.TrimSpace(strings.Join(lines, "\n"))
+}
+
+// unifiedDiff renders a whole-file line diff of a against b, based on their
+// longest common subsequence. Sources are small, so no hunks are computed.
+func unifiedDiff(nameA, nameB, a, b string) string {
+	la, lb := diffLines(a), diffLines(b)
+	lcs := make([][]int, len(la)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(lb)+1)
+	}
+	for i := len(la) - 1; i >= 0; i-- {
+		for j := len(lb) - 1; j >= 0; j-- {
+			if la[i] == lb[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+	var out strings.Builder
+	fmt.Fprintf(&out, "--- %s\n+++ %s\n", nameA, nameB)
+	i, j := 0, 0
+	for i < len(la) || j < len(lb) {
+		switch {
+		case i < len(la) && j < len(lb) && la[i] == lb[j]:
+			fmt.Fprintf(&out, " %s\n", la[i])
+			i++
+			j++
+		case i < len(la) && (j == len(lb) || lcs[i+1][j] >= lcs[i][j+1]):
+			fmt.Fprintf(&out, "-%s\n", la[i])
+			i++
+		default:
+			fmt.Fprintf(&out, "+%s\n", lb[j])
+			j++
+		}
+	}
+	return out.String()
+}
+
+// diffLines splits text into lines, with an empty text having none.
+func diffLines(text string) []string {
+	if text == "" {
+		return nil
+	}
+	return strings.Split(text, "\n")
+}
+
+// iSnapshotTheResponseAs stores a deep copy so later requests cannot alias it.
+func (c *apiContext) iSnapshotTheResponseAs(name string) error {
+	data, err := json.Marshal(c.ResponseBody)
+	if err != nil {
+		return err
+	}
+	var snapshot interface{}
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return err
+	}
+	c.Snapshots[name] = snapshot
+	return nil
+}
+
+func (c *apiContext) theResponseShouldMatchSnapshot(name string) error {
+	snapshot, ok := c.Snapshots[name]
+	if !ok {
+		return fmt.Errorf("snapshot '%s' not found", name)
+	}
+	if diff := jsonDiff(snapshot, c.ResponseBody); diff != "" {
+		return fmt.Errorf("response does not match snapshot '%s':\n%s", name, diff)
+	}
+	return nil
+}
+
+// responseString reads a string at a dotted path in the response.
+func (c *apiContext) responseString(field string) (string, error) {
+	raw, err := lookupPath(c.ResponseBody, field)
+	if err != nil {
+		return "", err
+	}
+	str, ok := raw.(string)
+	if !ok {
+		return "", fmt.Errorf("field '%s' is not a string: %v", field, raw)
+	}
+	return str, nil
+}
+
+// responseNumber reads a number at a dotted path in the response.
+func (c *apiContext) responseNumber(field string) (float64, error) {
+	raw, err := lookupPath(c.ResponseBody, field)
+	if err != nil {
+		return 0, err
+	}
+	num, ok := toFloat(raw)
+	if !ok {
+		return 0, fmt.Errorf("field '%s' is not a number: %v", field, raw)
+	}
+	return num, nil
+}
+
+// responseTimestamp reads an RFC3339 timestamp at a dotted path in the response.
+func (c *apiContext) responseTimestamp(field string) (time.Time, error) {
+	str, err := c.responseString(field)
+	if err != nil {
+		return time.Time{}, err
+	}
+	ts, err := time.Parse(time.RFC3339, str)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("field '%s' is not an RFC3339 timestamp: %v", field, err)
+	}
+	return ts, nil
+}
+
+func (c *apiContext) iSaveTheResponseFieldAsTimestamp(field, name string) error {
+	ts, err := c.responseTimestamp(field)
+	if err != nil {
+		return err
+	}
+	c.Timestamps[name] = ts
+	return nil
+}
+
+func (c *apiContext) theResponseFieldShouldBeAfterTimestamp(field, name string) error {
+	saved, ok := c.Timestamps[name]
+	if !ok {
+		return fmt.Errorf("timestamp '%s' not saved", name)
+	}
+	ts, err := c.responseTimestamp(field)
+	if err != nil {
+		return err
+	}
+	if !ts.After(saved) {
+		return fmt.Errorf("expected field '%s' (%s) to be after timestamp '%s' (%s)", field, ts.Format(time.RFC3339Nano), name, saved.Format(time.RFC3339Nano))
+	}
+	return nil
+}
+
+func (c *apiContext) iSaveTheResponseHeaderAs(header, name string) error {
+	value := c.Resp.Header.Get(header)
+	if value == "" {
+		return fmt.Errorf("response header '%s' not set", header)
+	}
+	c.Vars[name] = value
+	return nil
+}
+
+func (c *apiContext) iSaveTheResponseFieldAs(field, name string) error {
+	raw, err := lookupPath(c.ResponseBody, field)
+	if err != nil {
+		return err
+	}
+	c.Vars[name] = jsonScalarString(raw)
+	return nil
+}
+
+func (c *apiContext) theResponseFieldShouldEqualSaved(field, name string) error {
+	saved, ok := c.Vars[name]
+	if !ok {
+		return fmt.Errorf("variable '%s' not saved", name)
+	}
+	raw, err := lookupPath(c.ResponseBody, field)
+	if err != nil {
+		return err
+	}
+	if got := jsonScalarString(raw); got != saved {
+		return fmt.Errorf("expected field '%s' to equal saved '%s' ('%s'), got '%s'", field, name, saved, got)
+	}
+	return nil
 }
 
-func (c *apiContext) reset() {
-	c.Resp = nil
-	c.ResponseBody = nil
+func (c *apiContext) iSaveTheResponseFieldAsNumber(field, name string) error {
+	num, err := c.responseNumber(field)
+	if err != nil {
+		return err
+	}
+	c.NumVars[name] = num
+	return nil
 }
 
-// Step Definitions
-
-func (c *apiContext) theAPIIsAvailableAt(url string) error {
-	c.BaseURL = url
-	resp, err := http.Get(url + "/health")
+func (c *apiContext) theResponseFieldShouldBeGreaterThanNumber(field, name string) error {
+	saved, ok := c.NumVars[name]
+	if !ok {
+		return fmt.Errorf("number '%s' not saved", name)
+	}
+	num, err := c.responseNumber(field)
 	if err != nil {
-		return fmt.Errorf("API check failed: %v", err)
+		return err
 	}
-	if resp.StatusCode != 200 {
-		return fmt.Errorf("API responded with status %d", resp.StatusCode)
+	if num <= saved {
+		return fmt.Errorf("expected field '%s' (%v) to be greater than number '%s' (%v)", field, num, name, saved)
 	}
 	return nil
 }
 
-func (c *apiContext) aRuleTemplateExists(name string) error {
-	source := `rule("default").when(f => true).then(f => ({result: "ok"}))`
-	return c.createTemplate(name, source)
+// theResponseFieldShouldBeAValidUUID only accepts the canonical dashed form;
+// uuid.Parse alone also takes braced, urn:uuid: and undashed variants.
+func (c *apiContext) theResponseFieldShouldBeAValidUUID(field string) error {
+	str, err := c.responseString(field)
+	if err != nil {
+		return err
+	}
+	parsed, err := uuid.Parse(str)
+	if err != nil {
+		return fmt.Errorf("field '%s' is not a valid UUID: '%s' (%v)", field, str, err)
+	}
+	if !strings.EqualFold(str, parsed.String()) {
+		return fmt.Errorf("field '%s' is not a canonical UUID: '%s' (expected the form %s)", field, str, parsed)
+	}
+	return nil
 }
 
-func (c *apiContext) aRuleTemplateExistsWithSource(name, source string) error {
-	return c.createTemplate(name, source)
+// formatValidators backs "should be a valid <format>"; add an entry here and to
+// the step pattern to support a new format.
+var formatValidators = map[string]func(string) error{
+	"email": func(v string) error {
+		_, err := mail.ParseAddress(v)
+		return err
+	},
+	"url": func(v string) error {
+		_, err := url.ParseRequestURI(v)
+		return err
+	},
+	"date": func(v string) error {
+		_, err := time.Parse(time.DateOnly, v)
+		return err
+	},
+	"datetime": func(v string) error {
+		_, err := time.Parse(time.RFC3339, v)
+		return err
+	},
 }
 
-func (c *apiContext) createTemplate(name, source string) error {
-	payload := map[string]string{
-		"name":   name,
-		"source": strings.TrimSpace(source),
+func (c *apiContext) theResponseFieldShouldBeAValidFormat(field, format string) error {
+	validate, ok := formatValidators[format]
+	if !ok {
+		return fmt.Errorf("unknown format '%s'", format)
 	}
-	return c.sendPostRequest("/api/rule-templates", payload)
+	str, err := c.responseString(field)
+	if err != nil {
+		return err
+	}
+	if err := validate(str); err != nil {
+		return fmt.Errorf("field '%s' is not a valid %s: '%s' (%v)", field, format, str, err)
+	}
+	return nil
 }
 
-func (c *apiContext) aPolicyExists(name, templateName string) error {
-	templateID, ok := c.TemplateIDs[templateName]
-	if !ok {
-		return fmt.Errorf("template '%s' not found", templateName)
+// Enum values fetched from the server are shared by every scenario in the suite.
+var (
+	enumMu    sync.Mutex
+	enumCache = map[string][]string{}
+)
+
+// serverEnum fetches the allowed values of a server-defined enum from
+// /api/enums/<name>, either a list of strings or {"values": [...]}. It uses the
+// client directly so the response under test is left untouched.
+func (c *apiContext) serverEnum(name string) ([]string, error) {
+	endpoint := c.APIPrefix + "/api/enums/" + name
+	key := c.BaseURL + endpoint
+	enumMu.Lock()
+	defer enumMu.Unlock()
+	if values, ok := enumCache[key]; ok {
+		return values, nil
 	}
 
-	payload := map[string]interface{}{
-		"name":             name,
-		"rule_template_id": templateID,
-		"metadata":         map[string]interface{}{},
+	req, err := c.newRequest(http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, err
 	}
-	return c.sendPostRequest("/api/policies", payload)
+	resp, raw, err := c.doDirect(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching enum '%s' returned status %d", name, resp.StatusCode)
+	}
+	var body interface{}
+	if err := json.Unmarshal(raw, &body); err != nil {
+		return nil, fmt.Errorf("invalid enum '%s' response: %v", name, err)
+	}
+	if obj, ok := body.(map[string]interface{}); ok {
+		body = obj["values"]
+	}
+	list, ok := body.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("enum '%s' is not a list of values: %v", name, body)
+	}
+	values := make([]string, 0, len(list))
+	for _, v := range list {
+		values = append(values, fmt.Sprint(v))
+	}
+	enumCache[key] = values
+	return values, nil
 }
 
-func (c *apiContext) iPostToWith(endpoint string, docstring *godog.DocString) error {
-	var payload interface{}
-	if err := json.Unmarshal([]byte(docstring.Content), &payload); err != nil {
+func (c *apiContext) theResponseFieldShouldBeAValidStatus(field string) error {
+	raw, err := lookupPath(c.ResponseBody, field)
+	if err != nil {
 		return err
 	}
-	return c.sendPostRequest(endpoint, payload)
+	allowed, err := c.serverEnum("status")
+	if err != nil {
+		return err
+	}
+	value := fmt.Sprint(raw)
+	for _, v := range allowed {
+		if v == value {
+			return nil
+		}
+	}
+	return fmt.Errorf("field '%s' is '%s', not a valid status (allowed: %s)", field, value, strings.Join(allowed, ", "))
 }
 
-func (c *apiContext) iGet(endpoint string) error {
-	resp, err := http.Get(c.BaseURL + endpoint)
+func (c *apiContext) theAggregateOfFieldShouldBe(aggregate, field string, expected int) error {
+	list, err := c.responseList()
 	if err != nil {
 		return err
 	}
-	c.Resp = resp
-	return c.parseBody()
+	if len(list) == 0 {
+		return fmt.Errorf("cannot compute %s of '%s' over an empty list", aggregate, field)
+	}
+	var result float64
+	for i, item := range list {
+		raw, err := lookupPath(item, field)
+		if err != nil {
+			return fmt.Errorf("item %d: %v", i, err)
+		}
+		num, ok := toFloat(raw)
+		if !ok {
+			return fmt.Errorf("item %d: field '%s' is not a number: %v", i, field, raw)
+		}
+		switch {
+		case aggregate == "sum":
+			result += num
+		case i == 0 || num > result:
+			result = num
+		}
+	}
+	if result != float64(expected) {
+		return fmt.Errorf("expected %s of '%s' to be %d, got %v", aggregate, field, expected, result)
+	}
+	return nil
 }
 
-func (c *apiContext) iExecutePolicyWithFacts(name string, docstring *godog.DocString) error {
-	policyID, ok := c.PolicyIDs[name]
-	if !ok {
-		return fmt.Errorf("policy '%s' not found", name)
+func (c *apiContext) theListItemWhereShouldHaveFieldEqualTo(filterField, filterValue, field, value string) error {
+	matches, err := c.listItemsWhere(filterField, filterValue)
+	if err != nil {
+		return err
 	}
-
-	var facts interface{}
-	if err := json.Unmarshal([]byte(docstring.Content), &facts); err != nil {
+	if len(matches) != 1 {
+		return fmt.Errorf("expected exactly one item where '%s' is '%s', found %d", filterField, filterValue, len(matches))
+	}
+	got, err := lookupPath(matches[0], field)
+	if err != nil {
 		return err
 	}
-
-	payload := map[string]interface{}{
-		"policy_id": policyID,
-		"facts":     facts,
+	if jsonScalarString(got) != value {
+		return fmt.Errorf("expected '%s' of item where '%s' is '%s' to be '%s', got '%v'", field, filterField, filterValue, value, got)
 	}
-	return c.sendPostRequest("/api/execute", payload)
+	return nil
 }
 
-// Helpers
-
-func (c *apiContext) sendPostRequest(endpoint string, payload interface{}) error {
-	body, _ := json.Marshal(payload)
-	resp, err := http.Post(c.BaseURL+endpoint, "application/json", strings.NewReader(string(body)))
+// everyItemInTheResponseListShouldHave fails on an empty list, which would
+// otherwise pass vacuously.
+func (c *apiContext) everyItemInTheResponseListShouldHave(field, value string) error {
+	list, err := c.responseList()
 	if err != nil {
 		return err
 	}
-	c.Resp = resp
-	if err := c.parseBody(); err != nil {
-		return err
+	if len(list) == 0 {
+		return fmt.Errorf("response list is empty, expected items with '%s' equal to '%s'", field, value)
 	}
-
-	// Store IDs if present
-	bodyMap, ok := c.ResponseBody.(map[string]interface{})
-	if ok {
-		if id, ok := bodyMap["id"].(string); ok {
-			// Try to get name from payload - handle both map types
-			var name string
-			if payloadMap, ok := payload.(map[string]interface{}); ok {
-				if n, ok := payloadMap["name"].(string); ok {
-					name = n
-				}
-			} else if payloadMap, ok := payload.(map[string]string); ok {
-				name = payloadMap["name"]
-			}
-			if name != "" {
-				if strings.Contains(endpoint, "policies") {
-					c.PolicyIDs[name] = id
-				} else {
-					c.TemplateIDs[name] = id
-				}
-			}
+	var mismatches []string
+	for i, item := range list {
+		got, err := lookupPath(item, field)
+		if err != nil {
+			mismatches = append(mismatches, fmt.Sprintf("%d (missing)", i))
+			continue
+		}
+		if jsonScalarString(got) != value {
+			mismatches = append(mismatches, fmt.Sprintf("%d ('%v')", i, got))
 		}
 	}
+	if len(mismatches) > 0 {
+		return fmt.Errorf("%d of %d items do not have '%s' equal to '%s', at indices: %s", len(mismatches), len(list), field, value, strings.Join(mismatches, ", "))
+	}
 	return nil
 }
 
-func (c *apiContext) parseBody() error {
-	defer c.Resp.Body.Close()
-	return json.NewDecoder(c.Resp.Body).Decode(&c.ResponseBody)
+var keyStyles = map[string]*regexp.Regexp{
+	"snake_case": regexp.MustCompile(`^[a-z][a-z0-9]*(_[a-z0-9]+)*$`),
+	"camelCase":  regexp.MustCompile(`^[a-z][a-zA-Z0-9]*$`),
 }
 
-// Assertions
-
-func (c *apiContext) theResponseStatusShouldBe(code int) error {
-	if c.Resp.StatusCode != code {
-		return fmt.Errorf("expected status %d, got %d", code, c.Resp.StatusCode)
+// findBadKey returns the path of the first key, in sorted order, that does not
+// match the style.
+func findBadKey(path string, v interface{}, style *regexp.Regexp) string {
+	switch node := v.(type) {
+	case map[string]interface{}:
+		keys := make([]string, 0, len(node))
+		for k := range node {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			child := k
+			if path != "" {
+				child = path + "." + k
+			}
+			if !style.MatchString(k) {
+				return child
+			}
+			if bad := findBadKey(child, node[k], style); bad != "" {
+				return bad
+			}
+		}
+	case []interface{}:
+		for i, item := range node {
+			child := strconv.Itoa(i)
+			if path != "" {
+				child = path + "." + child
+			}
+			if bad := findBadKey(child, item, style); bad != "" {
+				return bad
+			}
+		}
 	}
-	return nil
+	return ""
 }
 
-func (c *apiContext) theResponseShouldContain(text string) error {
-	bodyBytes, _ := json.Marshal(c.ResponseBody)
-	if !strings.Contains(string(bodyBytes), text) {
-		return fmt.Errorf("response body does not contain '%s'", text)
+func (c *apiContext) allResponseKeysShouldBe(styleName string) error {
+	if bad := findBadKey("", c.ResponseBody, keyStyles[styleName]); bad != "" {
+		return fmt.Errorf("response key '%s' is not %s", bad, styleName)
 	}
 	return nil
 }
 
-func (c *apiContext) theResponseFieldShouldBe(field string, value int) error {
+// theResponseShouldHaveExactlyTheseFields expects a single-column table, one
+// top-level field name per row.
+func (c *apiContext) theResponseShouldHaveExactlyTheseFields(table *godog.Table) error {
 	bodyMap, ok := c.ResponseBody.(map[string]interface{})
 	if !ok {
 		return fmt.Errorf("response is not an object")
 	}
-	val, ok := bodyMap[field].(float64) // JSON numbers are float64
-	if !ok {
-		return fmt.Errorf("field '%s' not found or not a number", field)
+	expected := make(map[string]bool, len(table.Rows))
+	var missing []string
+	for _, row := range table.Rows {
+		field := row.Cells[0].Value
+		expected[field] = true
+		if _, ok := bodyMap[field]; !ok {
+			missing = append(missing, field)
+		}
 	}
-	if int(val) != value {
-		return fmt.Errorf("expected field '%s' to be %d, got %d", field, value, int(val))
+	var extra []string
+	for field := range bodyMap {
+		if !expected[field] {
+			extra = append(extra, field)
+		}
+	}
+	sort.Strings(extra)
+	var problems []string
+	if len(missing) > 0 {
+		problems = append(problems, "missing: "+strings.Join(missing, ", "))
+	}
+	if len(extra) > 0 {
+		problems = append(problems, "unexpected: "+strings.Join(extra, ", "))
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("response fields do not match (%s)", strings.Join(problems, "; "))
 	}
 	return nil
 }
 
-func (c *apiContext) theOutputFieldShouldBe(field string, value int) error {
+var paginationFields = []string{"total", "page", "per_page"}
+
+func (c *apiContext) theResponseShouldIncludePaginationMetadata() error {
 	bodyMap, ok := c.ResponseBody.(map[string]interface{})
 	if !ok {
-		return fmt.Errorf("response is not an object")
+		return fmt.Errorf("response is not a list envelope object, got %T", c.ResponseBody)
 	}
-	output, ok := bodyMap["output_facts"].(map[string]interface{})
-	if !ok {
-		return fmt.Errorf("output_facts not found")
+	var missing []string
+	for _, field := range paginationFields {
+		if _, ok := bodyMap[field]; !ok {
+			missing = append(missing, field)
+		}
 	}
-	val, ok := output[field].(float64)
+	if len(missing) > 0 {
+		return fmt.Errorf("response is missing pagination fields: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+func (c *apiContext) deletingTemplateShouldBeBlocked(templateName string) error {
+	templateID, ok := c.TemplateIDs[templateName]
 	if !ok {
-		return fmt.Errorf("output field '%s' not found or not a number", field)
+		return fmt.Errorf("template '%s' not found", templateName)
 	}
-	if int(val) != value {
-		return fmt.Errorf("expected output field '%s' to be %d, got %d", field, value, int(val))
+	err := c.sendRequest(http.MethodDelete, "/api/rule-templates/"+templateID, nil, nil)
+	if c.Resp == nil {
+		return err
+	}
+	if c.Resp.StatusCode != http.StatusConflict {
+		return fmt.Errorf("expected deleting template '%s' to be blocked with 409, got status %d: %v", templateName, c.Resp.StatusCode, c.ResponseBody)
+	}
+	if c.responseErrorMessage() == "" {
+		return fmt.Errorf("409 response for template '%s' has no error message: %v", templateName, c.ResponseBody)
 	}
 	return nil
 }
 
-func (c *apiContext) theExecutionShouldSucceed() error {
-	bodyMap, ok := c.ResponseBody.(map[string]interface{})
+// templateShouldHaveNPolicies uses /api/rule-templates/{id}/policies when the
+// server has it and otherwise filters /api/policies by rule_template_id.
+func (c *apiContext) templateShouldHaveNPolicies(templateName string, count int) error {
+	templateID, ok := c.TemplateIDs[templateName]
 	if !ok {
-		return fmt.Errorf("response is not an object")
+		return fmt.Errorf("template '%s' not found", templateName)
 	}
-	if success, ok := bodyMap["success"].(bool); !ok || !success {
-		return fmt.Errorf("execution failed: %v", c.ResponseBody)
+	err := c.iGet("/api/rule-templates/" + templateID + "/policies")
+	if c.Resp != nil && c.Resp.StatusCode == http.StatusNotFound {
+		err = c.iGet("/api/policies")
+	}
+	if err != nil {
+		return err
+	}
+	if c.Resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("listing policies returned status %d", c.Resp.StatusCode)
+	}
+	policies, err := c.listItemsWhere("rule_template_id", templateID)
+	if err != nil {
+		return err
+	}
+	if len(policies) != count {
+		names := make([]string, 0, len(policies))
+		for _, p := range policies {
+			if item, ok := p.(map[string]interface{}); ok {
+				names = append(names, fmt.Sprint(item["name"]))
+			}
+		}
+		return fmt.Errorf("expected template '%s' to have %d policies, got %d: %v", templateName, count, len(policies), names)
 	}
 	return nil
 }
 
-func (c *apiContext) theConditionShouldBeMet() error {
-	bodyMap, ok := c.ResponseBody.(map[string]interface{})
-	if !ok {
-		return fmt.Errorf("response is not an object")
+func (c *apiContext) theResponseShouldSerializeConsistently() error {
+	first, err := canonicalJSON(c.ResponseBody)
+	if err != nil {
+		return fmt.Errorf("failed to serialize response: %v", err)
 	}
-	if met, ok := bodyMap["condition_met"].(bool); !ok || !met {
-		return fmt.Errorf("condition not met: %v", c.ResponseBody)
+	second, err := canonicalJSON(c.ResponseBody)
+	if err != nil {
+		return fmt.Errorf("failed to serialize response: %v", err)
+	}
+	if !bytes.Equal(first, second) {
+		return fmt.Errorf("response serialized inconsistently:\n%s\n%s", first, second)
 	}
 	return nil
 }
 
-func (c *apiContext) theConditionShouldNotBeMet() error {
-	bodyMap, ok := c.ResponseBody.(map[string]interface{})
-	if !ok {
-		return fmt.Errorf("response is not an object")
+func (c *apiContext) theResponseShouldConformToOperation(operationID, specPath string) error {
+	doc, err := loadSpec(specPath)
+	if err != nil {
+		return err
 	}
-	if met, ok := bodyMap["condition_met"].(bool); !ok || met {
-		return fmt.Errorf("condition unexpectedly met: %v", c.ResponseBody)
+	op, err := findOperation(doc, operationID)
+	if err != nil {
+		return err
+	}
+	status := c.Resp.StatusCode
+	ref := op.Responses.Status(status)
+	if ref == nil {
+		ref = op.Responses.Default()
+	}
+	if ref == nil || ref.Value == nil {
+		return fmt.Errorf("operation '%s' does not document status %d", operationID, status)
+	}
+	media := ref.Value.Content.Get("application/json")
+	if media == nil || media.Schema == nil || media.Schema.Value == nil {
+		return fmt.Errorf("operation '%s' has no JSON schema for status %d", operationID, status)
+	}
+	if err := media.Schema.Value.VisitJSON(c.ResponseBody); err != nil {
+		return fmt.Errorf("response does not conform to operation '%s' (status %d): %v", operationID, status, err)
 	}
 	return nil
 }
 
-func (c *apiContext) theResponseFieldShouldBeNull(field string) error {
-	bodyMap, ok := c.ResponseBody.(map[string]interface{})
-	if !ok {
-		return fmt.Errorf("response is not an object")
+// theOpenAPISpecShouldBeValid fetches the server's published spec fresh,
+// bypassing the suite-wide spec cache.
+func (c *apiContext) theOpenAPISpecShouldBeValid() error {
+	if err := c.iGet("/openapi.json"); err != nil {
+		return err
 	}
-	val, ok := bodyMap[field]
-	if !ok {
-		return nil
+	if c.Resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("fetching /openapi.json returned status %d", c.Resp.StatusCode)
 	}
-	if val != nil {
-		return fmt.Errorf("expected field '%s' to be null, got %v", field, val)
+	loader := openapi3.NewLoader()
+	doc, err := loader.LoadFromData(c.RawBody)
+	if err != nil {
+		return fmt.Errorf("failed to parse /openapi.json: %v", err)
+	}
+	if err := doc.Validate(loader.Context); err != nil {
+		return fmt.Errorf("invalid OpenAPI spec at /openapi.json: %v", err)
 	}
 	return nil
 }
 
-func (c *apiContext) theResponseShouldBeAList() error {
-	_, ok := c.ResponseBody.([]interface{})
-	if !ok {
-		return fmt.Errorf("response is not a list, got %T", c.ResponseBody)
+func (c *apiContext) theResponseShouldRedirectTo(location string) error {
+	if c.Resp.StatusCode < 300 || c.Resp.StatusCode >= 400 {
+		return fmt.Errorf("expected a redirect, got status %d", c.Resp.StatusCode)
+	}
+	if got := c.Resp.Header.Get("Location"); got != location {
+		return fmt.Errorf("expected redirect to '%s', got '%s'", location, got)
+	}
+	return nil
+}
+
+// theResponseShouldSatisfyExpression evaluates a CEL expression with the decoded
+// body bound to "response", e.g. response.total == size(response.items).
+func (c *apiContext) theResponseShouldSatisfyExpression(expression string) error {
+	env, err := cel.NewEnv(cel.Variable("response", cel.DynType))
+	if err != nil {
+		return err
+	}
+	ast, issues := env.Compile(expression)
+	if issues != nil && issues.Err() != nil {
+		return fmt.Errorf("invalid expression '%s': %v", expression, issues.Err())
+	}
+	prg, err := env.Program(ast)
+	if err != nil {
+		return fmt.Errorf("invalid expression '%s': %v", expression, err)
+	}
+	// CEL cannot convert json.Number, so bind the float64 form
+	body := c.ResponseBody
+	if c.ExactNumbers {
+		if body, err = c.decodeBody(false); err != nil {
+			return err
+		}
+	}
+	out, _, err := prg.Eval(map[string]interface{}{"response": body})
+	if err != nil {
+		return fmt.Errorf("failed to evaluate '%s': %v", expression, err)
+	}
+	if result, ok := out.Value().(bool); !ok || !result {
+		return fmt.Errorf("expression '%s' evaluated to %v", expression, out.Value())
 	}
 	return nil
 }
@@ -258,11 +3524,33 @@ func (c *apiContext) theResponseShouldBeAList() error {
 // Test Runner
 
 func TestFeatures(t *testing.T) {
+	if err := configureTransport(); err != nil {
+		t.Fatalf("failed to configure HTTP transport: %v", err)
+	}
+	if ua := os.Getenv("GODOG_USER_AGENT"); ua != "" {
+		userAgent = ua
+	}
+	debug = os.Getenv("GODOG_DEBUG") == "1"
+	if pattern := os.Getenv("GODOG_NAME"); pattern != "" {
+		filter, err := regexp.Compile(pattern)
+		if err != nil {
+			t.Fatalf("invalid GODOG_NAME pattern '%s': %v", pattern, err)
+		}
+		scenarioFilter = filter
+	}
+	if dir := os.Getenv("GODOG_TRACE_DIR"); dir != "" {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			t.Fatalf("failed to create GODOG_TRACE_DIR '%s': %v", dir, err)
+		}
+		traceDir = dir
+	}
+
 	suite := godog.TestSuite{
 		ScenarioInitializer: InitializeScenario,
 		Options: &godog.Options{
 			Format:   "pretty",
 			Paths:    []string{"features"},
+			Tags:     os.Getenv("GODOG_TAGS"),
 			TestingT: t,
 		},
 	}
@@ -274,29 +3562,226 @@ func TestFeatures(t *testing.T) {
 
 func InitializeScenario(ctx *godog.ScenarioContext) {
 	api := &apiContext{
-		TemplateIDs: make(map[string]string),
-		PolicyIDs:   make(map[string]string),
+		Headers:         make(map[string]string),
+		TemplateIDs:     make(map[string]string),
+		PolicyIDs:       make(map[string]string),
+		PolicyTemplates: make(map[string]string),
+		TemplateSources: make(map[string]string),
+		Snapshots:       make(map[string]interface{}),
+		Timestamps:      make(map[string]time.Time),
+		Vars:            make(map[string]string),
+		NumVars:         make(map[string]float64),
+		IDField:         "id",
 	}
+	envErr := api.loadEnvironment()
 
 	ctx.Before(func(ctx context.Context, sc *godog.Scenario) (context.Context, error) {
+		if scenarioFilter != nil && !scenarioFilter.MatchString(sc.Name) {
+			return ctx, godog.ErrSkip
+		}
 		api.reset()
+		if traceDir != "" {
+			api.Transcript = new(bytes.Buffer)
+			fmt.Fprintf(api.Transcript, "# Scenario: %s (%s)\n\n", sc.Name, sc.Uri)
+		}
+		return ctx, envErr
+	})
+
+	ctx.After(func(ctx context.Context, sc *godog.Scenario, err error) (context.Context, error) {
+		client.CheckRedirect = nil
+		api.writeTranscript(sc, err)
 		return ctx, nil
 	})
 
 	ctx.Step(`^the API is available at "([^"]*)"$`, api.theAPIIsAvailableAt)
+	ctx.Step(`^the API version is "([^"]*)"$`, api.theAPIVersionIs)
+	ctx.Step(`^a second engine is available at "([^"]*)"$`, api.aSecondEngineIsAvailableAt)
+	ctx.Step(`^request validation is enabled against "([^"]*)"$`, api.requestValidationIsEnabledAgainst)
+	ctx.Step(`^redirects should not be followed$`, api.redirectsShouldNotBeFollowed)
+	ctx.Step(`^I set cookie "([^"]*)" to "([^"]*)"$`, api.iSetCookieTo)
+	ctx.Step(`^requests should use request ID "([^"]*)"$`, api.requestsShouldUseRequestID)
+	ctx.Step(`^this scenario requires feature "([^"]*)"$`, api.thisScenarioRequiresFeature)
+	ctx.Step(`^the ID field is "([^"]*)"$`, api.theIDFieldIs)
+	ctx.Step(`^response numbers are decoded exactly$`, api.responseNumbersAreDecodedExactly)
+	ctx.Step(`^the server state is reset$`, api.theServerStateIsReset)
 	ctx.Step(`^a rule template "([^"]*)" exists$`, api.aRuleTemplateExists)
 	ctx.Step(`^a rule template "([^"]*)" exists with source:$`, api.aRuleTemplateExistsWithSource)
+	ctx.Step(`^rule templates are loaded from directory "([^"]*)"$`, api.ruleTemplatesAreLoadedFromDirectory)
+	ctx.Step(`^creating (\d+) templates should yield increasing IDs$`, api.creatingTemplatesShouldYieldIncreasingIDs)
+	ctx.Step(`^validating invalid source should report an error at line (\d+)$`, api.validatingInvalidSourceShouldReportLine)
+	ctx.Step(`^creating template "([^"]*)" again should conflict$`, api.creatingTemplateAgainShouldConflict)
 	ctx.Step(`^a policy "([^"]*)" exists using template "([^"]*)"$`, api.aPolicyExists)
+	ctx.Step(`^the following policies exist:$`, api.theFollowingPoliciesExist)
+	ctx.Step(`^creating policy "([^"]*)" should make it retrievable$`, api.creatingPolicyShouldMakeItRetrievable)
+	ctx.Step(`^disabling policy "([^"]*)" should prevent execution$`, api.disablingPolicyShouldPreventExecution)
+	ctx.Step(`^creating policy "([^"]*)" twice should return the same ID$`, api.creatingPolicyTwiceShouldReturnTheSameID)
 	ctx.Step(`^I POST to "([^"]*)" with:$`, api.iPostToWith)
+	ctx.Step(`^I PATCH "([^"]*)" with:$`, api.iPatchWith)
+	ctx.Step(`^I POST to "([^"]*)" as "([^"]*)":$`, api.iPostToAs)
+	ctx.Step(`^I POST a payload of (\d+) kilobytes to "([^"]*)"$`, api.iPostAPayloadOfKilobytesTo)
+	ctx.Step(`^I POST gzipped to "([^"]*)" with:$`, api.iPostGzippedToWith)
+	ctx.Step(`^I send a CORS preflight for "([^"]*)" from origin "([^"]*)"$`, api.iSendACORSPreflightFrom)
 	ctx.Step(`^I GET "([^"]*)"$`, api.iGet)
+	ctx.Step(`^I HEAD "([^"]*)"$`, api.iHead)
+	ctx.Step(`^I download "([^"]*)"$`, api.iDownload)
+	ctx.Step(`^I GET "([^"]*)" accepting gzip$`, api.iGetAcceptingGzip)
 	ctx.Step(`^I execute policy "([^"]*)" with facts:$`, api.iExecutePolicyWithFacts)
+	ctx.Step(`^I execute policy "([^"]*)" with facts from file "([^"]*)"$`, api.iExecutePolicyWithFactsFromFile)
+	ctx.Step(`^I execute policy "([^"]*)" at ruleset version "([^"]*)" with facts:$`, api.iExecutePolicyAtRulesetVersionWithFacts)
+	ctx.Step(`^executing policy "([^"]*)" with idempotency key "([^"]*)" and facts:$`, api.executingPolicyWithIdempotencyKey)
+	ctx.Step(`^I dry-run policy "([^"]*)" with facts:$`, api.iDryRunPolicyWithFacts)
+	ctx.Step(`^I execute pipeline of policies "([^"]*)" with facts:$`, api.iExecutePipelineOfPolicies)
+	ctx.Step(`^policies "([^"]*)" on both engines should agree with facts:$`, api.policiesOnBothEnginesShouldAgree)
+	ctx.Step(`^reordering facts should not change the output for policy "([^"]*)":$`, api.reorderingFactsShouldNotChangeTheOutput)
+	ctx.Step(`^executing an unknown policy should return 404$`, api.executingAnUnknownPolicyShouldReturn404)
+	ctx.Step(`^executing policy "([^"]*)" with null facts should not crash:$`, api.executingPolicyWithNullFactsShouldNotCrash)
+	ctx.Step(`^executing policy "([^"]*)" with empty facts should use defaults$`, api.executingPolicyWithEmptyFactsShouldUseDefaults)
+	ctx.Step(`^the decision for facts should be:$`, api.theDecisionForFactsShouldBe)
+	ctx.Step(`^executing policy "([^"]*)" with facts should fail validation:$`, api.executingPolicyWithFactsShouldFailValidation)
+	ctx.Step(`^executing policy "([^"]*)" should time out with facts:$`, api.executingPolicyShouldTimeOutWithFacts)
+	ctx.Step(`^executing a deeply-chained policy "([^"]*)" should report a depth limit$`, api.executingADeeplyChainedPolicyShouldReportADepthLimit)
+	ctx.Step(`^re-creating template "([^"]*)" should preserve execution output with facts:$`, api.reCreatingTemplateShouldPreserveExecutionOutput)
+	ctx.Step(`^I repeat the last request$`, api.iRepeatTheLastRequest)
+	ctx.Step(`^the response list order should be stable across (\d+) calls$`, api.theResponseListOrderShouldBeStableAcrossCalls)
+	ctx.Step(`^executing policy "([^"]*)" twice with the same facts should yield identical output:$`, api.executingPolicyTwiceShouldYieldIdenticalOutput)
+	ctx.Step(`^I execute policy "([^"]*)" with tracing and facts:$`, api.iExecutePolicyWithTracingAndFacts)
 	ctx.Step(`^the response status should be (\d+)$`, api.theResponseStatusShouldBe)
+	ctx.Step(`^the response status should NOT be (\d+)$`, api.theResponseStatusShouldNotBe)
+	ctx.Step(`^the response trailer "([^"]*)" should be "([^"]*)"$`, api.theResponseTrailerShouldBe)
+	ctx.Step(`^the Content-Length header should match the body size$`, api.theContentLengthHeaderShouldMatchTheBodySize)
+	ctx.Step(`^the response should be gzip-encoded$`, api.theResponseShouldBeGzipEncoded)
+	ctx.Step(`^the downloaded file should be at least (\d+) bytes$`, api.theDownloadedFileShouldBeAtLeastBytes)
+	ctx.Step(`^the downloaded file should start with bytes "([^"]*)"$`, api.theDownloadedFileShouldStartWithBytes)
+	ctx.Step(`^the response should be cacheable for at least (\d+) seconds$`, api.theResponseShouldBeCacheableForAtLeast)
+	ctx.Step(`^the response should not be cacheable$`, api.theResponseShouldNotBeCacheable)
+	ctx.Step(`^the response should be a cache (HIT|MISS)$`, api.theResponseShouldBeACache)
+	ctx.Step(`^the response should use HTTP/2$`, api.theResponseShouldUseHTTP2)
+	ctx.Step(`^the response protocol should be "([^"]*)"$`, api.theResponseProtocolShouldBe)
+	ctx.Step(`^the cookie "([^"]*)" should be HttpOnly$`, api.theCookieShouldBeHttpOnly)
+	ctx.Step(`^the cookie "([^"]*)" should have SameSite "([^"]*)"$`, api.theCookieShouldHaveSameSite)
+	ctx.Step(`^the response should allow origin "([^"]*)"$`, api.theResponseShouldAllowOrigin)
+	ctx.Step(`^the API version should be at least "([^"]*)"$`, api.theAPIVersionShouldBeAtLeast)
 	ctx.Step(`^the response should contain "([^"]*)"$`, api.theResponseShouldContain)
+	ctx.Step(`^the response should match pattern "([^"]*)"$`, api.theResponseShouldMatchPattern)
 	ctx.Step(`^the response field "([^"]*)" should be (\d+)$`, api.theResponseFieldShouldBe)
+	ctx.Step(`^the response field "([^"]*)" should exactly be "([^"]*)"$`, api.theResponseFieldShouldExactlyBe)
 	ctx.Step(`^the output field "([^"]*)" should be (\d+)$`, api.theOutputFieldShouldBe)
+	ctx.Step(`^the output field "([^"]*)" should be between (\d+) and (\d+)$`, api.theOutputFieldShouldBeBetween)
+	ctx.Step(`^the output field "([^"]*)" should be a (number|string|boolean|object|array)$`, api.theOutputFieldShouldBeA)
+	ctx.Step(`^the output facts should contain key "([^"]*)"$`, api.theOutputFactsShouldContainKey)
+	ctx.Step(`^the output facts should not contain key "([^"]*)"$`, api.theOutputFactsShouldNotContainKey)
+	ctx.Step(`^the output facts should equal the input facts$`, api.theOutputFactsShouldEqualTheInputFacts)
 	ctx.Step(`^the execution should succeed$`, api.theExecutionShouldSucceed)
+	ctx.Step(`^the reported execution time should be under (\d+) ms$`, api.theReportedExecutionTimeShouldBeUnder)
+	ctx.Step(`^the execution should report at least (\d+) rules evaluated$`, api.theExecutionShouldReportAtLeastNRulesEvaluated)
+	ctx.Step(`^no more than (\d+) requests should have been made$`, api.noMoreThanNRequestsShouldHaveBeenMade)
 	ctx.Step(`^the condition should be met$`, api.theConditionShouldBeMet)
 	ctx.Step(`^the condition should NOT be met$`, api.theConditionShouldNotBeMet)
+	ctx.Step(`^exactly (\d+) rules should have fired$`, api.exactlyNRulesShouldHaveFired)
+	ctx.Step(`^only the first matching rule(?: "([^"]*)")? should fire$`, api.onlyTheFirstMatchingRuleShouldFire)
+	ctx.Step(`^the rules should have fired in order:$`, api.theRulesShouldHaveFiredInOrder)
+	ctx.Step(`^the trace should include "([^"]*)"$`, api.theTraceShouldInclude)
+	ctx.Step(`^the field "([^"]*)" should be (true|false)$`, api.theFieldShouldBeBool)
 	ctx.Step(`^the response field "([^"]*)" should be null$`, api.theResponseFieldShouldBeNull)
 	ctx.Step(`^the response should be a list$`, api.theResponseShouldBeAList)
+	ctx.Step(`^the response should be an empty list$`, api.theResponseShouldBeAnEmptyList)
+	ctx.Step(`^the response should conform to operation "([^"]*)" in "([^"]*)"$`, api.theResponseShouldConformToOperation)
+	ctx.Step(`^the OpenAPI spec should be valid$`, api.theOpenAPISpecShouldBeValid)
+	ctx.Step(`^the field "([^"]*)" should have (\d+) distinct values across the response list$`, api.theFieldShouldHaveDistinctValues)
+	ctx.Step(`^the endpoint "([^"]*)" should require authentication$`, api.theEndpointShouldRequireAuthentication)
+	ctx.Step(`^"([^"]*)" to "([^"]*)" should not be allowed$`, api.methodToEndpointShouldNotBeAllowed)
+	ctx.Step(`^there should be (\d+) rule templates$`, api.thereShouldBeNRuleTemplates)
+	ctx.Step(`^policy "([^"]*)" should use template "([^"]*)"$`, api.policyShouldUseTemplate)
+	ctx.Step(`^policy "([^"]*)" metadata "([^"]*)" should be "([^"]*)"$`, api.policyMetadataShouldBe)
+	ctx.Step(`^template "([^"]*)" source should be unchanged$`, api.templateSourceShouldBeUnchanged)
+	ctx.Step(`^I snapshot the response as "([^"]*)"$`, api.iSnapshotTheResponseAs)
+	ctx.Step(`^the response should match snapshot "([^"]*)"$`, api.theResponseShouldMatchSnapshot)
+	ctx.Step(`^I save the response field "([^"]*)" as timestamp "([^"]*)"$`, api.iSaveTheResponseFieldAsTimestamp)
+	ctx.Step(`^the response field "([^"]*)" should be after timestamp "([^"]*)"$`, api.theResponseFieldShouldBeAfterTimestamp)
+	ctx.Step(`^I save the response field "([^"]*)" as number "([^"]*)"$`, api.iSaveTheResponseFieldAsNumber)
+	ctx.Step(`^I save the response header "([^"]*)" as "([^"]*)"$`, api.iSaveTheResponseHeaderAs)
+	ctx.Step(`^I save the response field "([^"]*)" as "([^"]*)"$`, api.iSaveTheResponseFieldAs)
+	ctx.Step(`^the response field "([^"]*)" should equal saved "([^"]*)"$`, api.theResponseFieldShouldEqualSaved)
+	ctx.Step(`^the response field "([^"]*)" should be greater than number "([^"]*)"$`, api.theResponseFieldShouldBeGreaterThanNumber)
+	ctx.Step(`^the response field "([^"]*)" should be a valid UUID$`, api.theResponseFieldShouldBeAValidUUID)
+	ctx.Step(`^the response field "([^"]*)" should be a valid (email|url|date|datetime)$`, api.theResponseFieldShouldBeAValidFormat)
+	ctx.Step(`^the response field "([^"]*)" should be a valid status$`, api.theResponseFieldShouldBeAValidStatus)
+	ctx.Step(`^the (sum|max) of field "([^"]*)" across the response list should be (\d+)$`, api.theAggregateOfFieldShouldBe)
+	ctx.Step(`^the response list item where "([^"]*)" is "([^"]*)" should have field "([^"]*)" equal to "([^"]*)"$`, api.theListItemWhereShouldHaveFieldEqualTo)
+	ctx.Step(`^every item in the response list should have "([^"]*)" equal to "([^"]*)"$`, api.everyItemInTheResponseListShouldHave)
+	ctx.Step(`^all response keys should be (snake_case|camelCase)$`, api.allResponseKeysShouldBe)
+	ctx.Step(`^the response should have exactly these fields:$`, api.theResponseShouldHaveExactlyTheseFields)
+	ctx.Step(`^the response should include pagination metadata$`, api.theResponseShouldIncludePaginationMetadata)
+	ctx.Step(`^deleting template "([^"]*)" should be blocked while policies exist$`, api.deletingTemplateShouldBeBlocked)
+	ctx.Step(`^template "([^"]*)" should have (\d+) policies$`, api.templateShouldHaveNPolicies)
+	ctx.Step(`^the response should serialize consistently$`, api.theResponseShouldSerializeConsistently)
+	ctx.Step(`^the response should redirect to "([^"]*)"$`, api.theResponseShouldRedirectTo)
+	ctx.Step(`^the response should satisfy expression "([^"]*)"$`, api.theResponseShouldSatisfyExpression)
+}
+
+func TestUnifiedDiff(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b string
+		want string
+	}{
+		{"equal", "a\nb", "a\nb", " a\n b\n"},
+		{"insert", "a\nc", "a\nb\nc", " a\n+b\n c\n"},
+		{"append", "a", "a\nb", " a\n+b\n"},
+		{"delete", "a\nb\nc", "a\nc", " a\n-b\n c\n"},
+		{"replace", "a\nb\nc", "a\nx\nc", " a\n-b\n+x\n c\n"},
+		{"both empty", "", "", ""},
+		{"from empty", "", "a\nb", "+a\n+b\n"},
+		{"to empty", "a\nb", "", "-a\n-b\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			want := "--- sent\n+++ stored\n" + tt.want
+			if got := unifiedDiff("sent", "stored", tt.a, tt.b); got != want {
+				t.Errorf("unifiedDiff(%q, %q) =\n%s\nwant:\n%s", tt.a, tt.b, got, want)
+			}
+		})
+	}
+}
+
+// TestPostGzippedRoundTrip checks that "I POST gzipped" sends a body the
+// server can decompress back to the docstring.
+func TestPostGzippedRoundTrip(t *testing.T) {
+	const body = `{"name": "gzip-template", "source": "rule(\"r\")"}`
+	var encoding, contentType string
+	var received []byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		encoding = r.Header.Get("Content-Encoding")
+		contentType = r.Header.Get("Content-Type")
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer gz.Close()
+		if received, err = io.ReadAll(gz); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{}`))
+	}))
+	defer srv.Close()
+
+	c := &apiContext{BaseURL: srv.URL, Headers: map[string]string{}}
+	if err := c.iPostGzippedToWith("/api/rule-templates", &godog.DocString{Content: body}); err != nil {
+		t.Fatal(err)
+	}
+	if c.Resp.StatusCode != http.StatusOK {
+		t.Fatalf("server rejected the body with status %d: %s", c.Resp.StatusCode, c.RawBody)
+	}
+	if encoding != "gzip" {
+		t.Errorf("Content-Encoding = %q, want gzip", encoding)
+	}
+	if contentType != "application/json" {
+		t.Errorf("Content-Type = %q, want application/json", contentType)
+	}
+	if string(received) != body {
+		t.Errorf("decompressed body = %q, want %q", received, body)
+	}
 }
@@ -13,6 +13,7 @@ Feature: Policy Execution
       rule("discount").when(f => f.amount > 100).then(f => ({ discount: f.amount * 0.1 }))
       """
     And a policy "exec-test-policy" exists using template "exec-discount-template"
+    And policy "exec-test-policy" should use template "exec-discount-template"
     When I execute policy "exec-test-policy" with facts:
       """
       {"amount": 150}
@@ -34,6 +35,7 @@ Feature: Policy Execution
       """
     Then the execution should succeed
     And the condition should NOT be met
+    And the output facts should not contain key "discount"
 
   @execute @boundary
   Scenario: Execute policy at boundary value
@@ -48,3 +50,19 @@ Feature: Policy Execution
       """
     Then the execution should succeed
     And the condition should NOT be met
+
+  @execute @fixture
+  Scenario: Execute policy with facts from a fixture file
+    Given a rule template "fixture-discount-template" exists with source:
+      """
+      rule("discount").when(f => f.amount > 100).then(f => ({ discount: f.amount * 0.1 }))
+      """
+    And a policy "fixture-policy" exists using template "fixture-discount-template"
+    When I execute policy "fixture-policy" with facts from file "discount-facts.json"
+    Then the execution should succeed
+    And the condition should be met
+    And the output field "discount" should be 15
+
+  @execute @not-found
+  Scenario: Execute an unknown policy
+    Then executing an unknown policy should return 404
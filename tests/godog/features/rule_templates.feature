@@ -16,7 +16,9 @@ Feature: Rule Template Management
     Then the response status should be 201
     And the response should contain "bdd-discount-rule"
     And the response field "version" should be 1
+    And the response field "id" should be a valid UUID
     And the response field "compiled_js" should be null
+    And all response keys should be snake_case
 
   @version
   Scenario: Create a new version of existing template